@@ -0,0 +1,69 @@
+package mr
+
+// submits jobs to, and follows them on, a coordinator
+// made with MakeJobCoordinator.
+type JobClient struct {
+	coordinator *coordinatorClient
+}
+
+// connect to the coordinator at address, of the form
+// unix:///path/to/socket or tcp://host:port. empty means the
+// address workers dial by default.
+func NewJobClient(address string) (*JobClient, error) {
+	if address == "" {
+		address = defaultCoordinatorAddress()
+	}
+
+	network, addr, err := parseAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &JobClient{coordinator: &coordinatorClient{network: network, address: addr}}, nil
+}
+
+// returns the id of the new job. the request is not resent once it
+// may have reached the coordinator, so that a job is never submitted
+// twice; after an error, the job may or may not have been submitted.
+func (jc *JobClient) Submit(spec JobSpec) (int, error) {
+	args := SubmitJobArgs{Spec: spec}
+	reply := SubmitJobReply{}
+
+	if err := jc.coordinator.invokeOnce("Coordinator.SubmitJob", &args, &reply); err != nil {
+		return 0, err
+	}
+
+	return reply.JobId, nil
+}
+
+func (jc *JobClient) Status(jobId int) (*JobStatusReply, error) {
+	args := JobStatusArgs{JobId: jobId}
+	reply := JobStatusReply{}
+
+	if err := jc.coordinator.invoke("Coordinator.JobStatus", &args, &reply); err != nil {
+		return nil, err
+	}
+
+	return &reply, nil
+}
+
+// cancelling a job that is already cancelled succeeds.
+func (jc *JobClient) Cancel(jobId int) error {
+	args := CancelJobArgs{JobId: jobId}
+	reply := CancelJobReply{}
+
+	return jc.coordinator.invokeOnce("Coordinator.CancelJob", &args, &reply)
+}
+
+// finish the current task of a worker, then send it away,
+// e.g. to take its machine out for maintenance.
+func (jc *JobClient) DrainWorker(workerId int) error {
+	args := DrainWorkerArgs{WorkerId: workerId}
+	reply := DrainWorkerReply{}
+
+	return jc.coordinator.invoke("Coordinator.DrainWorker", &args, &reply)
+}
+
+func (jc *JobClient) Close() {
+	jc.coordinator.close()
+}
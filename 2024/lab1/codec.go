@@ -0,0 +1,304 @@
+package mr
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// intermediate files start with a header line naming the codec of the
+// records that follow, e.g. "MRKV1 binary-flate\n". files without a
+// header hold one JSON object per record, which is all that workers
+// from before codecs can read, so the default codec writes no header.
+const codecMagic = "MRKV1"
+
+// codec of intermediate files unless the job picks another one.
+const DefaultCodec = "json"
+
+type KVEncoder interface {
+	Encode(kv *KeyValue) error
+	// flush buffered records; does not close the underlying writer.
+	Close() error
+}
+
+type KVDecoder interface {
+	// returns io.EOF after the last record.
+	Decode(kv *KeyValue) error
+}
+
+type Codec interface {
+	NewEncoder(w io.Writer) KVEncoder
+	NewDecoder(r *bufio.Reader) (KVDecoder, error)
+}
+
+var (
+	codecsMutex sync.Mutex
+	codecs      = map[string]Codec{
+		"json":         jsonCodec{},
+		"binary":       binaryCodec{},
+		"binary-flate": flateCodec{},
+		"binary-gzip":  gzipCodec{},
+	}
+)
+
+// make a codec available under name, in the workers and in the
+// coordinator, which checks the codec of every job. codec names
+// may not contain white space.
+func RegisterCodec(name string, codec Codec) {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+
+	codecs[name] = codec
+}
+
+func lookupCodec(name string) (Codec, error) {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+
+	if name == "" {
+		name = DefaultCodec
+	}
+
+	codec, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec %q", name)
+	}
+
+	return codec, nil
+}
+
+// an encoder that writes the header of codec first,
+// unless codec is the default.
+func newKVEncoder(w io.Writer, name string) (KVEncoder, error) {
+	if name == "" {
+		name = DefaultCodec
+	}
+
+	codec, err := lookupCodec(name)
+	if err != nil {
+		return nil, err
+	}
+
+	bw := bufio.NewWriter(w)
+
+	if name != DefaultCodec {
+		if _, err := fmt.Fprintf(bw, "%s %s\n", codecMagic, name); err != nil {
+			return nil, err
+		}
+	}
+
+	return &bufferedEncoder{KVEncoder: codec.NewEncoder(bw), w: bw}, nil
+}
+
+type bufferedEncoder struct {
+	KVEncoder
+	w *bufio.Writer
+}
+
+func (e *bufferedEncoder) Close() error {
+	if err := e.KVEncoder.Close(); err != nil {
+		return err
+	}
+
+	return e.w.Flush()
+}
+
+// a decoder for whatever codec the header names.
+func newKVDecoder(r io.Reader) (KVDecoder, error) {
+	br := bufio.NewReader(r)
+
+	prefix, err := br.Peek(len(codecMagic) + 1)
+	if err != nil || string(prefix) != codecMagic+" " {
+		// written with the default codec, or before files had headers.
+		return jsonCodec{}.NewDecoder(br)
+	}
+
+	header, err := br.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("bad intermediate file header: %v", err)
+	}
+
+	codec, err := lookupCodec(strings.TrimSpace(strings.TrimPrefix(header, codecMagic)))
+	if err != nil {
+		return nil, err
+	}
+
+	return codec.NewDecoder(br)
+}
+
+type jsonCodec struct{}
+
+type jsonEncoder struct {
+	enc *json.Encoder
+}
+
+type jsonDecoder struct {
+	dec *json.Decoder
+}
+
+func (jsonCodec) NewEncoder(w io.Writer) KVEncoder {
+	return &jsonEncoder{enc: json.NewEncoder(w)}
+}
+
+func (jsonCodec) NewDecoder(r *bufio.Reader) (KVDecoder, error) {
+	return &jsonDecoder{dec: json.NewDecoder(r)}, nil
+}
+
+func (e *jsonEncoder) Encode(kv *KeyValue) error {
+	return e.enc.Encode(kv)
+}
+
+func (e *jsonEncoder) Close() error {
+	return nil
+}
+
+func (d *jsonDecoder) Decode(kv *KeyValue) error {
+	return d.dec.Decode(kv)
+}
+
+// every record is the length of the key, the key, the length of the
+// value and the value, lengths as uvarints.
+type binaryCodec struct{}
+
+// the longest key or value of the binary codec, so that a corrupt
+// length cannot make the decoder allocate any amount of memory.
+const maxBinaryStringSize = 256 << 20
+
+var errRecordTooLarge = errors.New("record too large")
+
+// how much more the decoder allocates at a time for a long string.
+const binaryReadChunk = 64 << 10
+
+type binaryEncoder struct {
+	w   io.Writer
+	buf []byte
+}
+
+type binaryDecoder struct {
+	r *bufio.Reader
+}
+
+func (binaryCodec) NewEncoder(w io.Writer) KVEncoder {
+	return &binaryEncoder{w: w}
+}
+
+func (binaryCodec) NewDecoder(r *bufio.Reader) (KVDecoder, error) {
+	return &binaryDecoder{r: r}, nil
+}
+
+func (e *binaryEncoder) Encode(kv *KeyValue) error {
+	if len(kv.Key) > maxBinaryStringSize || len(kv.Value) > maxBinaryStringSize {
+		return errRecordTooLarge
+	}
+
+	e.buf = e.buf[:0]
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(kv.Key)))
+	e.buf = append(e.buf, kv.Key...)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(kv.Value)))
+	e.buf = append(e.buf, kv.Value...)
+
+	_, err := e.w.Write(e.buf)
+	return err
+}
+
+func (e *binaryEncoder) Close() error {
+	return nil
+}
+
+func (d *binaryDecoder) Decode(kv *KeyValue) error {
+	key, err := d.readString()
+	if err != nil {
+		// io.EOF only between records.
+		return err
+	}
+
+	value, err := d.readString()
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+
+	kv.Key, kv.Value = key, value
+
+	return nil
+}
+
+func (d *binaryDecoder) readString() (string, error) {
+	n, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return "", err
+	}
+
+	if n > maxBinaryStringSize {
+		return "", errRecordTooLarge
+	}
+
+	// grow with what is actually there rather than with n, which a
+	// truncated file overstates.
+	buf := make([]byte, 0, min(n, binaryReadChunk))
+
+	for uint64(len(buf)) < n {
+		chunk := int(min(n-uint64(len(buf)), binaryReadChunk))
+		buf = slices.Grow(buf, chunk)
+
+		m, err := io.ReadFull(d.r, buf[len(buf):len(buf)+chunk])
+		buf = buf[:len(buf)+m]
+
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return "", io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+	}
+
+	return string(buf), nil
+}
+
+// the binary format, compressed with flate.
+type flateCodec struct{}
+
+type compressedEncoder struct {
+	KVEncoder
+	c io.WriteCloser
+}
+
+func (e *compressedEncoder) Close() error {
+	return e.c.Close()
+}
+
+func (flateCodec) NewEncoder(w io.Writer) KVEncoder {
+	c, _ := flate.NewWriter(w, flate.DefaultCompression)
+	return &compressedEncoder{KVEncoder: binaryCodec{}.NewEncoder(c), c: c}
+}
+
+func (flateCodec) NewDecoder(r *bufio.Reader) (KVDecoder, error) {
+	return binaryCodec{}.NewDecoder(bufio.NewReader(flate.NewReader(r)))
+}
+
+// the binary format, compressed with gzip.
+type gzipCodec struct{}
+
+func (gzipCodec) NewEncoder(w io.Writer) KVEncoder {
+	c := gzip.NewWriter(w)
+	return &compressedEncoder{KVEncoder: binaryCodec{}.NewEncoder(c), c: c}
+}
+
+func (gzipCodec) NewDecoder(r *bufio.Reader) (KVDecoder, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return binaryCodec{}.NewDecoder(bufio.NewReader(gz))
+}
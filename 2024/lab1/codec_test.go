@@ -0,0 +1,160 @@
+package mr
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var codecTestKVs = []KeyValue{
+	{Key: "a", Value: "1"},
+	{Key: "", Value: ""},
+	{Key: "key with spaces", Value: "line\nbreak"},
+	{Key: "ünïcode", Value: strings.Repeat("x", 1000)},
+	{Key: "a", Value: "2"},
+	{Key: "long", Value: strings.Repeat("y", 3*binaryReadChunk+1)},
+}
+
+func encodeKVs(t *testing.T, codec string, kva []KeyValue) []byte {
+	var buf bytes.Buffer
+
+	enc, err := newKVEncoder(&buf, codec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range kva {
+		if err := enc.Encode(&kva[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func decodeKVs(t *testing.T, data []byte) []KeyValue {
+	dec, err := newKVDecoder(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var kva []KeyValue
+
+	for {
+		var kv KeyValue
+		err := dec.Decode(&kv)
+		if err == io.EOF {
+			return kva
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		kva = append(kva, kv)
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, codec := range []string{"", "json", "binary", "binary-flate", "binary-gzip"} {
+		for _, kva := range [][]KeyValue{nil, codecTestKVs} {
+			if got := decodeKVs(t, encodeKVs(t, codec, kva)); !reflect.DeepEqual(got, kva) {
+				t.Errorf("codec %q: got %v, want %v", codec, got, kva)
+			}
+		}
+	}
+}
+
+func TestCodecHeader(t *testing.T) {
+	// the default codec writes what workers from before codecs read.
+	for _, codec := range []string{"", DefaultCodec} {
+		data := encodeKVs(t, codec, codecTestKVs)
+
+		dec := json.NewDecoder(bytes.NewReader(data))
+		for _, want := range codecTestKVs {
+			var kv KeyValue
+			if err := dec.Decode(&kv); err != nil || kv != want {
+				t.Fatalf("codec %q: plain JSON decoding got %v, %v, want %v", codec, kv, err, want)
+			}
+		}
+	}
+
+	for _, codec := range []string{"binary", "binary-flate", "binary-gzip"} {
+		header, _, _ := bytes.Cut(encodeKVs(t, codec, nil), []byte("\n"))
+
+		if want := codecMagic + " " + codec; string(header) != want {
+			t.Errorf("codec %q: header %q, want %q", codec, header, want)
+		}
+	}
+}
+
+func TestCodecUnknown(t *testing.T) {
+	if _, err := newKVEncoder(io.Discard, "nope"); err == nil {
+		t.Errorf("encoder for an unknown codec")
+	}
+
+	if _, err := newKVDecoder(strings.NewReader(codecMagic + " nope\n")); err == nil {
+		t.Errorf("decoder for a file with an unknown codec")
+	}
+}
+
+func TestCodecCorruptLength(t *testing.T) {
+	header := codecMagic + " binary\n"
+
+	lengths := map[error]uint64{
+		errRecordTooLarge:   maxBinaryStringSize + 1,
+		io.ErrUnexpectedEOF: 3 * binaryReadChunk,
+	}
+
+	for want, length := range lengths {
+		data := binary.AppendUvarint([]byte(header), length)
+		data = append(data, "abc"...)
+
+		dec, err := newKVDecoder(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var kv KeyValue
+		if err := dec.Decode(&kv); err != want {
+			t.Errorf("length %d: got error %v, want %v", length, err, want)
+		}
+	}
+}
+
+// upper-cases keys on the way in, to show that it was used.
+type upperCodec struct{}
+
+type upperEncoder struct {
+	KVEncoder
+}
+
+func (e upperEncoder) Encode(kv *KeyValue) error {
+	return e.KVEncoder.Encode(&KeyValue{Key: strings.ToUpper(kv.Key), Value: kv.Value})
+}
+
+func (upperCodec) NewEncoder(w io.Writer) KVEncoder {
+	return upperEncoder{jsonCodec{}.NewEncoder(w)}
+}
+
+func (upperCodec) NewDecoder(r *bufio.Reader) (KVDecoder, error) {
+	return jsonCodec{}.NewDecoder(r)
+}
+
+func TestRegisterCodec(t *testing.T) {
+	RegisterCodec("test-upper", upperCodec{})
+
+	got := decodeKVs(t, encodeKVs(t, "test-upper", []KeyValue{{Key: "a", Value: "1"}}))
+
+	if want := []KeyValue{{Key: "A", Value: "1"}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
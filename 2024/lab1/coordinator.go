@@ -1,174 +1,1071 @@
 package mr
 
 import (
+	"cmp"
 	"encoding/gob"
-	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"net/rpc"
 	"os"
+	"path/filepath"
+	"slices"
 	"sync"
 	"time"
 )
 
+// workers report their current task every HeartbeatInterval. a task
+// lease survives one missed heartbeat; after that the task is handed
+// to someone else.
+const (
+	HeartbeatInterval = 500 * time.Millisecond
+	LeaseTimeout      = 2 * HeartbeatInterval
+)
+
+// once every task is completed, workers get an exit task the next time
+// they ask for work. Done() waits this long for all of them to
+// acknowledge it.
+const ExitGracePeriod = 3 * time.Second
+
+// how long GetTask holds on to a worker when there is nothing to hand out.
+const LongPollTimeout = 10 * time.Second
+
+// once no more than this fraction of a phase's tasks is left, tasks
+// that have been running for SpeculationSlowdown times the phase's
+// average runtime get a backup attempt.
+const (
+	SpeculationThreshold = 0.2
+	SpeculationSlowdown  = 2
+)
+
 type Coordinator struct {
-	tasks []ITask
-	mutex sync.Mutex
+	// in the order they were submitted.
+	jobs         []*job
+	nextJobId    int
+	workers      map[int]*WorkerInfo
+	nextWorkerId int
+	journal      *journal
+	address      string
+	// when the last job finished.
+	completedAt time.Time
+	mutex       sync.Mutex
+	// signalled whenever a task may have become schedulable.
+	cond                 *sync.Cond
+	speculationThreshold float64
+	scheduling           SchedulingPolicy
+	metrics              *coordinatorMetrics
+	// tell workers to exit once every job is finished. false
+	// for coordinators that wait for jobs to be submitted.
+	exitWhenDone bool
+	// describe the job passed to MakeCoordinator or MakePipeline.
+	partitioner    PartitionerConfig
+	codec          string
+	splitSize      int64
+	inputFormat    string
+	outputFormat   string
+	identityReduce bool
+	maxAttempts    int
+	onFailure      FailurePolicy
+	skipBadRecords bool
+	// overrides the input formats' record boundaries for all jobs.
+	boundary RecordBoundary
+	// whether committing outputs has failed before, to explain it once.
+	commitFailed bool
+}
+
+type CoordinatorOption func(*Coordinator)
+
+// listen on unix:///path/to/socket or tcp://host:port
+// instead of the default UNIX socket. the coordinator commits outputs
+// by renaming the files workers wrote, by the paths relative to their
+// working directory, so workers on other machines must share its
+// filesystem and run in the same directory.
+func WithAddress(address string) CoordinatorOption {
+	return func(c *Coordinator) {
+		c.address = address
+	}
+}
+
+// back up stragglers once no more than this fraction of a phase is
+// left, instead of SpeculationThreshold. zero disables backups.
+func WithSpeculationThreshold(fraction float64) CoordinatorOption {
+	return func(c *Coordinator) {
+		c.speculationThreshold = fraction
+	}
+}
+
+// route keys to reduce tasks with a registered partitioner
+// rather than by hash.
+func WithPartitioner(config PartitionerConfig) CoordinatorOption {
+	return func(c *Coordinator) {
+		c.partitioner = config
+	}
+}
+
+// write intermediate files with a registered codec
+// rather than DefaultCodec.
+func WithIntermediateCodec(name string) CoordinatorOption {
+	return func(c *Coordinator) {
+		c.codec = name
+	}
+}
+
+// cut input files into splits of about size bytes, one map task each,
+// instead of handing every file to a single map task.
+func WithSplitSize(size int64) CoordinatorOption {
+	return func(c *Coordinator) {
+		c.splitSize = size
+	}
+}
+
+// end splits where boundary says records start, rather than
+// where the job's input format says they do.
+func WithRecordBoundary(boundary RecordBoundary) CoordinatorOption {
+	return func(c *Coordinator) {
+		c.boundary = boundary
+	}
+}
+
+// read map input with a registered input format
+// rather than as whole files.
+func WithInputFormat(name string) CoordinatorOption {
+	return func(c *Coordinator) {
+		c.inputFormat = name
+	}
+}
+
+// write reduce output with a registered output format
+// rather than as "key value" lines.
+func WithOutputFormat(name string) CoordinatorOption {
+	return func(c *Coordinator) {
+		c.outputFormat = name
+	}
+}
+
+// write out the sorted map output as is, so that
+// workers need no reduce function.
+func WithIdentityReduce() CoordinatorOption {
+	return func(c *Coordinator) {
+		c.identityReduce = true
+	}
+}
+
+// give up on a task after n failed attempts,
+// rather than after DefaultMaxAttempts.
+func WithMaxAttempts(n int) CoordinatorOption {
+	return func(c *Coordinator) {
+		c.maxAttempts = n
+	}
+}
+
+// skip bad inputs, or fail the job, once a
+// task has used up its attempts.
+func WithFailurePolicy(policy FailurePolicy) CoordinatorOption {
+	return func(c *Coordinator) {
+		c.onFailure = policy
+	}
+}
+
+// leave out the records map and reduce functions panic on,
+// one failed attempt at a time.
+func WithSkipBadRecords() CoordinatorOption {
+	return func(c *Coordinator) {
+		c.skipBadRecords = true
+	}
+}
+
+// share the workers between jobs according to policy
+// rather than first come, first served.
+func WithScheduling(policy SchedulingPolicy) CoordinatorOption {
+	return func(c *Coordinator) {
+		c.scheduling = policy
+	}
+}
+
+type WorkerInfo struct {
+	Id       int
+	LastSeen time.Time
+	// the worker acknowledged its exit task.
+	Exited bool
+	// the worker is finishing its current task, if any, and gets
+	// no more. once it acknowledges its exit task it is Exited, late
+	// heartbeats do not bring it back, and it is forgotten when they stop.
+	Draining bool
 }
 
 type TaskType string
 
-const Map, Reduce, Idle TaskType = "map", "reduce", "idle"
+const Map, Reduce, Idle, Exit TaskType = "map", "reduce", "idle", "exit"
 
 type ITask interface {
-	Schedule()
-	Reschedule()
-	Complete()
+	Schedule(workerId int, leaseExpiry time.Time)
+	Renew(workerId int, attempt int, leaseExpiry time.Time) bool
+	ExpireLeases(now time.Time) []Lease
+	Complete(attempt int)
+	Fail(attempt int, reason string)
+	Skip()
 	GetId() int
+	GetType() TaskType
+	GetJob() int
+	GetStage() string
+	GetAttempt() int
+	SetAttempt(attempt int)
+	GetCommittedAttempt() int
+	GetLeases() []Lease
+	GetRuntime() time.Duration
+	GetFailures() int
+	GetError() string
 	Is(taskType TaskType) bool
 	Equals(task ITask) bool
 	IsScheduled() bool
 	IsCompleted() bool
+	IsSkipped() bool
+	Clone() ITask
+}
+
+// a running attempt of a task, held by one worker.
+type Lease struct {
+	Attempt   int
+	WorkerId  int
+	Expiry    time.Time
+	StartedAt time.Time
 }
 
+// every call to Schedule starts a new attempt. the worker tags its files
+// with the attempt, and only one attempt per task is ever committed.
+// several attempts may be running at once when the coordinator backs
+// up a straggler.
 type Task struct {
-	Id        int
-	Type      TaskType
-	Scheduled bool
-	Completed bool
+	Id   int
+	Type TaskType
+	Job  int
+	// map task ids are unique across the stages of a pipeline,
+	// reduce task ids are the partitions of their stage.
+	Stage            string
+	Completed        bool
+	Attempt          int
+	CommittedAttempt int
+	Leases           []Lease
+	// how long the committed attempt took.
+	Runtime time.Duration
+	// attempts that failed, and why the last of them did.
+	Failures int
+	Error    string
+	// given up on after too many failures. a skipped
+	// task counts as completed, but has no output.
+	Skipped bool
 }
 
 type MapTask struct {
 	Task
 	Filename string
-	NReduce  int
+	// the byte range of Filename to map. zero Length
+	// means up to the end of the file.
+	Offset      int64
+	Length      int64
+	NReduce     int
+	Partitioner PartitionerConfig
+	// codec of the intermediate files. reduce tasks detect
+	// the codec of every file they read on their own.
+	Codec       string
+	InputFormat string
+	// set if NReduce is zero, the job is map-only and the task
+	// writes its output here instead of intermediate files.
+	OutputFilename string
+	OutputFormat   string
+	// records earlier attempts panicked on, see skip.go.
+	SkipRecords []int
 }
 
 type IdleTask struct {
 	Task
 }
 
+// tells the worker that the job is over.
+type ExitTask struct {
+	Task
+}
+
 type ReduceTask struct {
 	Task
+	// intermediate files of this partition, one per map task that emitted
+	// anything for it. filled in as map tasks are committed.
+	InputFilenames []string
+	OutputFilename string
+	OutputFormat   string
+	// write every KeyValue of the input as is, without a reduce function.
+	Identity bool
+	// keys earlier attempts panicked on, see skip.go.
+	SkipKeys []string
 }
 
-func (t *Task) Schedule() {
-	t.Scheduled = true
+func (t *Task) Schedule(workerId int, leaseExpiry time.Time) {
+	t.Attempt++
+	t.Leases = append(t.Leases, Lease{Attempt: t.Attempt, WorkerId: workerId, Expiry: leaseExpiry, StartedAt: time.Now()})
+}
+
+// extend the lease of a running attempt. returns false if
+// the worker does not hold a lease for that attempt.
+func (t *Task) Renew(workerId int, attempt int, leaseExpiry time.Time) bool {
+	for i := range t.Leases {
+		if t.Leases[i].Attempt == attempt && t.Leases[i].WorkerId == workerId {
+			t.Leases[i].Expiry = leaseExpiry
+			return true
+		}
+	}
+
+	return false
+}
+
+// drop the leases that ran out and return them.
+func (t *Task) ExpireLeases(now time.Time) []Lease {
+	var live, expired []Lease
+
+	for _, lease := range t.Leases {
+		if now.After(lease.Expiry) {
+			expired = append(expired, lease)
+		} else {
+			live = append(live, lease)
+		}
+	}
+
+	t.Leases = live
+
+	return expired
+}
+
+// the remaining attempts lose; their workers find out
+// from the next heartbeat.
+func (t *Task) Complete(attempt int) {
+	for _, lease := range t.Leases {
+		if lease.Attempt == attempt {
+			t.Runtime = time.Since(lease.StartedAt)
+		}
+	}
+
+	t.Completed = true
+	t.CommittedAttempt = attempt
+	t.Leases = nil
 }
 
-func (t *Task) Reschedule() {
-	t.Scheduled = false
+// the worker gave up on the attempt, or its lease expired.
+func (t *Task) Fail(attempt int, reason string) {
+	t.Failures++
+	t.Error = reason
+	t.Leases = slices.DeleteFunc(t.Leases, func(lease Lease) bool {
+		return lease.Attempt == attempt
+	})
 }
 
-func (t *Task) Complete() {
+func (t *Task) Skip() {
 	t.Completed = true
+	t.Skipped = true
+	t.Leases = nil
 }
 
 func (t *Task) GetId() int {
 	return t.Id
 }
 
+func (t *Task) GetType() TaskType {
+	return t.Type
+}
+
+func (t *Task) GetJob() int {
+	return t.Job
+}
+
+func (t *Task) GetStage() string {
+	return t.Stage
+}
+
+func (t *Task) GetAttempt() int {
+	return t.Attempt
+}
+
+func (t *Task) SetAttempt(attempt int) {
+	t.Attempt = attempt
+}
+
+func (t *Task) GetCommittedAttempt() int {
+	return t.CommittedAttempt
+}
+
+func (t *Task) GetLeases() []Lease {
+	return t.Leases
+}
+
+func (t *Task) GetRuntime() time.Duration {
+	return t.Runtime
+}
+
+func (t *Task) GetFailures() int {
+	return t.Failures
+}
+
+func (t *Task) GetError() string {
+	return t.Error
+}
+
 func (t *Task) Is(taskType TaskType) bool {
 	return t.Type == taskType
 }
 
 func (t *Task) Equals(task ITask) bool {
-	return task.Is(t.Type) && task.GetId() == t.Id
+	return task.Is(t.Type) && task.GetId() == t.Id && task.GetJob() == t.Job && task.GetStage() == t.Stage
 }
 
 func (t *Task) IsScheduled() bool {
-	return t.Scheduled
+	return len(t.Leases) > 0
 }
 
 func (t *Task) IsCompleted() bool {
 	return t.Completed
 }
 
-func IsMappingComplete(tasks []ITask) bool {
-	for _, task := range tasks {
-		if task.Is(Map) && !task.IsCompleted() {
-			return false
-		}
+func (t *Task) IsSkipped() bool {
+	return t.Skipped
+}
+
+// replies are encoded after the mutex is released,
+// so hand out copies rather than the tasks themselves.
+// workers have no use for the leases.
+func (t *MapTask) Clone() ITask {
+	clone := *t
+	clone.Leases = nil
+	clone.Partitioner.SplitPoints = append([]string(nil), t.Partitioner.SplitPoints...)
+	clone.SkipRecords = append([]int(nil), t.SkipRecords...)
+	return &clone
+}
+
+func (t *ReduceTask) Clone() ITask {
+	clone := *t
+	clone.Leases = nil
+	clone.InputFilenames = append([]string(nil), t.InputFilenames...)
+	clone.SkipKeys = append([]string(nil), t.SkipKeys...)
+	return &clone
+}
+
+func (t *IdleTask) Clone() ITask {
+	clone := *t
+	clone.Leases = nil
+	return &clone
+}
+
+func (t *ExitTask) Clone() ITask {
+	clone := *t
+	clone.Leases = nil
+	return &clone
+}
+
+func (c *Coordinator) RegisterWorker(args *RegisterWorkerArgs, reply *RegisterWorkerReply) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.nextWorkerId++
+	c.touch(c.nextWorkerId)
+	c.record(JournalEntry{Op: OpRegistered, WorkerId: c.nextWorkerId})
+
+	reply.WorkerId = c.nextWorkerId
+	reply.HeartbeatInterval = HeartbeatInterval
+
+	return nil
+}
+
+// stop handing tasks to a worker, e.g. to take its machine out for
+// maintenance. the attempt it is running, if any, still counts; after
+// that it is told to exit.
+func (c *Coordinator) DrainWorker(args *DrainWorkerArgs, reply *DrainWorkerReply) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	worker, ok := c.workers[args.WorkerId]
+	if !ok {
+		return fmt.Errorf("unknown worker %d", args.WorkerId)
 	}
 
-	return true
+	if !worker.Draining {
+		worker.Draining = true
+		log.Printf("draining worker %d", args.WorkerId)
+	}
+
+	// a worker waiting for a task is told to exit right away.
+	c.cond.Broadcast()
+
+	return nil
 }
 
+func (c *Coordinator) Heartbeat(args *HeartbeatArgs, reply *HeartbeatReply) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.touch(args.WorkerId)
+	c.metrics.updateWorker(args.WorkerId, args.Metrics)
+
+	if args.Task == nil || args.Task.Is(Idle) || args.Task.Is(Exit) {
+		return nil
+	}
+
+	j, task := c.findTask(args.Task)
+	attempt := args.Task.GetAttempt()
+
+	if task == nil {
+		return nil
+	}
+
+	// another attempt won, or nobody wants the result any more;
+	// either way this one is wasted effort.
+	if j.state == JobCancelled || j.state == JobFailed || task.IsCompleted() && task.GetCommittedAttempt() != attempt {
+		reply.Cancel = true
+		return nil
+	}
+
+	// the lease is only renewed for its current holder. a worker whose
+	// lease already expired learns about it from the missing ack, but
+	// may keep going: if it finishes first, its attempt still counts.
+	reply.Ack = task.Renew(args.WorkerId, attempt, time.Now().Add(LeaseTimeout))
+
+	return nil
+}
+
+// blocks until there is a task for the worker, the job is over, or
+// LongPollTimeout passes. in the last case the worker gets an idle
+// task and asks again.
 func (c *Coordinator) GetTask(args *GetTaskArgs, reply *GetTaskReply) error {
+	defer c.metrics.observeRPC("GetTask", time.Now())
+
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	for i, task := range c.tasks {
-		if task.Is(Map) && !task.IsCompleted() && !task.IsScheduled() {
-			c.tasks[i].Schedule()
-			reply.Task = task
+	c.touch(args.WorkerId)
 
-			go func() {
-				time.Sleep(10 * time.Second)
+	timedOut := false
+	timer := time.AfterFunc(LongPollTimeout, func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
 
-				if !task.IsCompleted() {
-					c.tasks[i].Reschedule()
-				}
-			}()
+		timedOut = true
+		c.cond.Broadcast()
+	})
+	defer timer.Stop()
 
+	for {
+		if c.exitWhenDone && c.allJobsFinished() || c.draining(args.WorkerId) {
+			reply.Task = &ExitTask{Task: Task{Type: Exit}}
 			return nil
 		}
 
-		if task.Is(Reduce) && !task.IsCompleted() && !task.IsScheduled() && !IsMappingComplete(c.tasks) {
-			// wait until mapping ends
-			reply.Task = &IdleTask{Task: Task{Type: Idle}}
+		if task := c.nextTask(args.WorkerId); task != nil {
+			if j := c.job(task.GetJob()); j.state == JobQueued {
+				j.state = JobRunning
+			}
+
+			task.Schedule(args.WorkerId, time.Now().Add(LeaseTimeout))
+			c.record(JournalEntry{Op: OpScheduled, Job: task.GetJob(), Stage: task.GetStage(), Type: task.GetType(), Id: task.GetId(), Attempt: task.GetAttempt()})
+			reply.Task = task.Clone()
+
+			if task.GetAttempt() > 1 {
+				c.metrics.reschedule(task.GetType())
+			}
 
 			return nil
-		} else if task.Is(Reduce) && !task.IsCompleted() && !task.IsScheduled() {
-			reply.Task = task
+		}
 
+		if timedOut {
+			reply.Task = &IdleTask{Task: Task{Type: Idle}}
 			return nil
 		}
+
+		// everything left is in progress, but any of it may come
+		// back if its worker dies, reduce tasks become available
+		// once the last map task of their stage is completed,
+		// stages once the stages they read are done, and new
+		// jobs may be submitted.
+		c.cond.Wait()
+	}
+}
+
+// the first task that can be handed out right now, if any. fresh
+// tasks of any job go before backup attempts.
+func (c *Coordinator) nextTask(workerId int) ITask {
+	jobs := c.schedulingOrder()
+
+	for _, j := range jobs {
+		if task := j.readyTask(); task != nil {
+			return task
+		}
+	}
+
+	for _, j := range jobs {
+		if task := j.backupTask(workerId, c.speculationThreshold); task != nil {
+			return task
+		}
 	}
 
-	return errors.New("no more tasks")
+	return nil
+}
+
+// the unfinished jobs, in the order in which they get to hand out tasks.
+func (c *Coordinator) schedulingOrder() []*job {
+	var jobs []*job
+
+	for _, j := range c.jobs {
+		if !j.isFinished() {
+			jobs = append(jobs, j)
+		}
+	}
+
+	if c.scheduling == FairShare {
+		slices.SortStableFunc(jobs, func(a, b *job) int {
+			return cmp.Compare(a.running(), b.running())
+		})
+	}
+
+	return jobs
 }
 
 func (c *Coordinator) CompleteTask(args *CompleteTaskArgs, reply *CompleteTaskReply) error {
+	defer c.metrics.observeRPC("CompleteTask", time.Now())
+
 	// we do not need to register end of idle tasks
 	if args.Task.Is(Idle) {
 		reply.Ack = true
 		return nil
 	}
 
-	for i := 0; i < len(c.tasks); i++ {
-		if c.tasks[i].Equals(args.Task) {
-			c.tasks[i].Complete()
-			//fmt.Printf("Task completed: %+v\n", c.tasks[i])
-			reply.Ack = true
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-			return nil
+	c.touch(args.WorkerId)
+
+	if args.Task.Is(Exit) {
+		// workers that never registered are not tracked.
+		if worker, ok := c.workers[args.WorkerId]; ok {
+			worker.Exited = true
+
+			if worker.Draining {
+				log.Printf("worker %d drained", args.WorkerId)
+			}
+		}
+
+		reply.Ack = true
+		return nil
+	}
+
+	j, task := c.findTask(args.Task)
+
+	if task == nil {
+		return fmt.Errorf("task not found: %+v", args.Task)
+	}
+
+	attempt := args.Task.GetAttempt()
+
+	if j.state == JobCancelled || j.state == JobFailed {
+		log.Printf("rejecting attempt %d of %+v: job %d %s", attempt, task, j.id, j.state)
+		discardOutputs(args.Outputs)
+		return nil
+	}
+
+	// the live attempt normally wins, but an attempt whose lease already
+	// expired is just as good if it finishes first. whatever comes after
+	// the first successful attempt is a duplicate.
+	if task.IsCompleted() {
+		log.Printf("rejecting attempt %d of %+v: already completed by attempt %d", attempt, task, task.GetCommittedAttempt())
+		discardOutputs(args.Outputs)
+		return nil
+	}
+
+	if attempt < 1 || attempt > task.GetAttempt() {
+		log.Printf("rejecting unknown attempt %d of %+v", attempt, task)
+		discardOutputs(args.Outputs)
+		return nil
+	}
+
+	if err := commitOutputs(args.Outputs); err != nil {
+		log.Printf("cannot commit attempt %d of %+v: %v", attempt, task, err)
+		if !c.commitFailed {
+			c.commitFailed = true
+			log.Printf("error: cannot rename the files of workers; workers must share the filesystem of the coordinator and run in its working directory")
+		}
+		discardOutputs(args.Outputs)
+		return nil
+	}
+
+	task.Complete(attempt)
+	c.metrics.observeTask(task.GetType(), task.GetRuntime())
+	//fmt.Printf("Task completed: %+v\n", task)
+
+	entry := JournalEntry{Op: OpCompleted, Job: j.id, Stage: task.GetStage(), Type: task.GetType(), Id: task.GetId(), Attempt: attempt, Counters: args.Counters}
+
+	if task.Is(Map) {
+		j.recordIntermediates(task.GetStage(), task.GetId(), args.IntermediateFilenames)
+		entry.IntermediateFilenames = args.IntermediateFilenames
+	}
+
+	j.addCounters(task, args.Counters)
+	c.record(entry)
+
+	if j.allTasksCompleted() {
+		c.finish(j, JobSucceeded)
+		j.reportCounters()
+	}
+
+	c.cond.Broadcast()
+
+	reply.Ack = true
+
+	return nil
+}
+
+// a worker gave up on an attempt: its map or reduce function
+// panicked, or its input could not be read.
+func (c *Coordinator) FailTask(args *FailTaskArgs, reply *FailTaskReply) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.touch(args.WorkerId)
+
+	j, task := c.findTask(args.Task)
+
+	if task == nil {
+		return fmt.Errorf("task not found: %+v", args.Task)
+	}
+
+	attempt := args.Task.GetAttempt()
+	log.Printf("attempt %d of job %d %s task %d failed on worker %d: %s", attempt, j.id, task.GetType(), task.GetId(), args.WorkerId, args.Reason)
+
+	// an attempt whose lease expired was already counted.
+	if j.isFinished() || task.IsCompleted() || !slices.ContainsFunc(task.GetLeases(), func(lease Lease) bool {
+		return lease.Attempt == attempt
+	}) {
+		return nil
+	}
+
+	if args.BadRecord != nil && j.spec.SkipBadRecords {
+		skipRecord(task, *args.BadRecord)
+	}
+
+	c.record(JournalEntry{Op: OpFailed, Job: j.id, Stage: task.GetStage(), Type: task.GetType(), Id: task.GetId(), Attempt: attempt, Reason: args.Reason, BadRecord: args.BadRecord})
+	c.metrics.fail(task.GetType())
+	c.failAttempt(j, task, attempt, args.Reason)
+
+	// the task is up for grabs again, unless its job is over.
+	c.cond.Broadcast()
+
+	return nil
+}
+
+// count a failed attempt. a task that failed MaxAttempts times fails
+// its job, or is skipped if it is a map task of a job that skips bad
+// inputs.
+func (c *Coordinator) failAttempt(j *job, task ITask, attempt int, reason string) {
+	task.Fail(attempt, reason)
+
+	if j.isFinished() || task.IsCompleted() || task.GetFailures() < j.maxAttempts() {
+		return
+	}
+
+	if j.spec.OnFailure == SkipBadInputs && task.Is(Map) {
+		task.Skip()
+		log.Printf("job %d skipped %s", j.id, j.describeFailure(task))
+
+		if j.allTasksCompleted() {
+			c.finish(j, JobSucceeded)
+			j.reportCounters()
+		}
+
+		return
+	}
+
+	j.failure = j.describeFailure(task)
+	c.finish(j, JobFailed)
+	log.Printf("job %d failed: %s", j.id, j.failure)
+}
+
+// promote the files of an accepted attempt to their final names. rename
+// is atomic, so readers see either nothing or the whole file.
+func commitOutputs(outputs []OutputFile) error {
+	dirs := make(map[string]bool)
+
+	for _, output := range outputs {
+		if err := os.Rename(output.TempName, output.FinalName); err != nil {
+			return err
+		}
+
+		dirs[filepath.Dir(output.FinalName)] = true
+	}
+
+	// make the renames themselves durable.
+	for dir := range dirs {
+		if err := syncDir(dir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+func discardOutputs(outputs []OutputFile) {
+	for _, output := range outputs {
+		os.Remove(output.TempName)
+	}
+}
+
+// queue a job. it starts as soon as the scheduling policy gives it
+// a worker.
+func (c *Coordinator) SubmitJob(args *SubmitJobArgs, reply *SubmitJobReply) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	j, err := newJob(c.nextJobId, args.Spec, c.boundary)
+	if err != nil {
+		return err
+	}
+
+	c.nextJobId++
+	c.jobs = append(c.jobs, j)
+	c.record(JournalEntry{Op: OpJob, Job: j.id, Spec: &j.spec})
+	log.Printf("job %d submitted: %d tasks", j.id, len(j.tasks))
+
+	c.cond.Broadcast()
+
+	reply.JobId = j.id
+
+	return nil
+}
+
+func (c *Coordinator) JobStatus(args *JobStatusArgs, reply *JobStatusReply) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	j := c.job(args.JobId)
+	if j == nil {
+		return fmt.Errorf("unknown job %d", args.JobId)
+	}
+
+	*reply = j.status()
+
+	return nil
+}
+
+// stop handing out the tasks of a job. running attempts are told to
+// stop with their next heartbeat; output already committed stays.
+func (c *Coordinator) CancelJob(args *CancelJobArgs, reply *CancelJobReply) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	j := c.job(args.JobId)
+	if j == nil {
+		return fmt.Errorf("unknown job %d", args.JobId)
+	}
+
+	// cancelling twice is no error, so that clients need not know
+	// whether their first request got through.
+	if j.state == JobCancelled {
+		return nil
+	}
+
+	if j.isFinished() {
+		return fmt.Errorf("job %d already %s", j.id, j.state)
+	}
+
+	c.finish(j, JobCancelled)
+	c.record(JournalEntry{Op: OpCancelled, Job: j.id})
+	log.Printf("job %d cancelled", j.id)
+
+	// waiting workers may be told to exit now.
+	c.cond.Broadcast()
+
+	return nil
+}
+
+func (c *Coordinator) findTask(task ITask) (*job, ITask) {
+	j := c.job(task.GetJob())
+	if j == nil {
+		return nil, nil
+	}
+
+	for _, t := range j.tasks {
+		if t.Equals(task) {
+			return j, t
+		}
+	}
+
+	return nil, nil
+}
+
+func (c *Coordinator) job(id int) *job {
+	for _, j := range c.jobs {
+		if j.id == id {
+			return j
+		}
+	}
+
+	return nil
+}
+
+// move a job to a final state.
+func (c *Coordinator) finish(j *job, state JobState) {
+	j.state = state
+	j.finishedAt = time.Now()
+
+	if c.allJobsFinished() {
+		c.completedAt = j.finishedAt
+	}
+}
+
+// record that a worker is alive. workers that are not known yet
+// (e.g. registered with an earlier coordinator) are adopted.
+func (c *Coordinator) touch(workerId int) {
+	if workerId == 0 {
+		return
+	}
+
+	if _, ok := c.workers[workerId]; !ok {
+		c.workers[workerId] = &WorkerInfo{Id: workerId}
+
+		if workerId > c.nextWorkerId {
+			c.nextWorkerId = workerId
 		}
 	}
 
-	return fmt.Errorf("task not found: %+v", args.Task)
+	c.workers[workerId].LastSeen = time.Now()
+}
+
+func (c *Coordinator) draining(workerId int) bool {
+	worker, ok := c.workers[workerId]
+	return ok && worker.Draining
+}
+
+// periodically take tasks away from workers whose lease expired,
+// forget workers that stopped sending heartbeats, and let waiting
+// workers look for work again.
+func (c *Coordinator) monitor() {
+	for {
+		time.Sleep(HeartbeatInterval / 2)
+
+		c.mutex.Lock()
+		now := time.Now()
+
+		c.expireLeases(now)
+
+		// tasks may have lost their last lease, and running tasks may
+		// have become slow enough for a backup attempt.
+		c.cond.Broadcast()
+
+		for id, worker := range c.workers {
+			if now.Sub(worker.LastSeen) > LeaseTimeout {
+				delete(c.workers, id)
+			}
+		}
+
+		c.mutex.Unlock()
+	}
+}
+
+// fail the attempts whose lease ran out before now.
+func (c *Coordinator) expireLeases(now time.Time) {
+	for _, j := range c.jobs {
+		for _, task := range j.tasks {
+			for _, lease := range task.ExpireLeases(now) {
+				log.Printf("lease of worker %d on attempt %d of job %d %s task %d expired", lease.WorkerId, lease.Attempt, j.id, task.GetType(), task.GetId())
+
+				// the worker may have died on the task.
+				if !j.isFinished() && !task.IsCompleted() {
+					reason := fmt.Sprintf("lease of worker %d expired", lease.WorkerId)
+					c.record(JournalEntry{Op: OpFailed, Job: j.id, Stage: task.GetStage(), Type: task.GetType(), Id: task.GetId(), Attempt: lease.Attempt, Reason: reason})
+					c.metrics.fail(task.GetType())
+					c.failAttempt(j, task, lease.Attempt, reason)
+				}
+			}
+		}
+	}
 }
 
 func (c *Coordinator) server() {
 	rpc.Register(c)
 	rpc.HandleHTTP()
-	//l, e := net.Listen("tcp", ":1234")
-	sockname := coordinatorSock()
-	os.Remove(sockname)
-	l, e := net.Listen("unix", sockname)
+	c.handleStatus()
+	c.handleMetrics()
+	network, addr, err := parseAddress(c.address)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if network == "unix" {
+		os.Remove(addr)
+	}
+	l, e := net.Listen(network, addr)
 	if e != nil {
 		log.Fatal("listen error:", e)
 	}
+	log.Printf("listening on %v://%v", network, l.Addr())
 	go http.Serve(l, nil)
 }
 
+// totals of the counters of the job passed to MakeCoordinator,
+// over all accepted attempts.
+func (c *Coordinator) Counters() map[string]int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	counters := make(map[string]int64)
+
+	if j := c.job(0); j != nil {
+		for name, value := range j.counters {
+			counters[name] = value
+		}
+	}
+
+	return counters
+}
+
 // main/mrcoordinator.go calls Done() periodically to find out
 // if the entire job has finished.
 func (c *Coordinator) Done() bool {
-	for _, task := range c.tasks {
-		if !task.IsCompleted() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.exitWhenDone || !c.allJobsFinished() || !c.workersExited() {
+		return false
+	}
+
+	if err := c.journal.retire(); err != nil {
+		log.Printf("cannot remove %v: %v", c.journal.filename, err)
+	}
+
+	return true
+}
+
+// give the workers a chance to hear that the job is over, rather
+// than have them find out by failing to reach the coordinator.
+func (c *Coordinator) workersExited() bool {
+	if time.Since(c.completedAt) > ExitGracePeriod {
+		return true
+	}
+
+	for _, worker := range c.workers {
+		if !worker.Exited {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c *Coordinator) allJobsFinished() bool {
+	for _, j := range c.jobs {
+		if !j.isFinished() {
 			return false
 		}
 	}
@@ -178,27 +1075,115 @@ func (c *Coordinator) Done() bool {
 
 // create a Coordinator.
 // main/mrcoordinator.go calls this function.
-// nReduce is the number of reduce tasks to use.
-func MakeCoordinator(files []string, nReduce int) *Coordinator {
+// nReduce is the number of reduce tasks to use, zero for a map-only job.
+func MakeCoordinator(files []string, nReduce int, opts ...CoordinatorOption) *Coordinator {
+	return MakePipeline(files, []Stage{{NReduce: nReduce}}, opts...)
+}
+
+// create a Coordinator that runs the stages of a pipeline, in
+// dependency order, over files. it is done when all stages are.
+func MakePipeline(files []string, stages []Stage, opts ...CoordinatorOption) *Coordinator {
+	c := newCoordinator(opts...)
+	c.exitWhenDone = true
+
+	spec := JobSpec{
+		Files:          files,
+		Partitioner:    c.partitioner,
+		Codec:          c.codec,
+		SplitSize:      c.splitSize,
+		MaxAttempts:    c.maxAttempts,
+		OnFailure:      c.onFailure,
+		SkipBadRecords: c.skipBadRecords,
+	}
+
+	for _, stage := range stages {
+		if stage.InputFormat == "" {
+			stage.InputFormat = c.inputFormat
+		}
+
+		if stage.OutputFormat == "" {
+			stage.OutputFormat = c.outputFormat
+		}
+
+		if c.identityReduce {
+			stage.IdentityReduce = true
+		}
+
+		spec.Stages = append(spec.Stages, stage)
+	}
+
+	if err := checkStages(spec.Stages); err != nil {
+		panic(err.Error())
+	}
+
+	j, err := newJob(0, spec, c.boundary)
+	if err != nil {
+		log.Fatalf("cannot create job: %v", err)
+	}
+
+	c.jobs = append(c.jobs, j)
+	c.nextJobId = 1
+
+	c.start()
+	return c
+}
+
+// create a Coordinator that has no job of its own, but runs the
+// jobs submitted with SubmitJob. it is never done.
+func MakeJobCoordinator(opts ...CoordinatorOption) *Coordinator {
+	c := newCoordinator(opts...)
+	c.nextJobId = 1
+
+	c.start()
+	return c
+}
+
+func newCoordinator(opts ...CoordinatorOption) *Coordinator {
 	gob.Register(&MapTask{})
 	gob.Register(&ReduceTask{})
 	gob.Register(&IdleTask{})
+	gob.Register(&ExitTask{})
+
+	c := &Coordinator{
+		workers: make(map[int]*WorkerInfo),
+		address: defaultCoordinatorAddress(),
 
-	if nReduce < 1 {
-		panic("nReduce must be greater than 0")
+		speculationThreshold: SpeculationThreshold,
+		scheduling:           FIFO,
+		metrics:              newCoordinatorMetrics(),
 	}
 
-	var tasks []ITask
+	c.cond = sync.NewCond(&c.mutex)
 
-	for i, filename := range files {
-		tasks = append(tasks, &MapTask{Task: Task{Id: i, Type: Map}, Filename: filename, NReduce: nReduce})
+	for _, opt := range opts {
+		opt(c)
 	}
 
-	for i := 0; i < nReduce; i++ {
-		tasks = append(tasks, &ReduceTask{Task: Task{Id: i, Type: Reduce}})
+	return c
+}
+
+// pick up where the journal left off and start serving workers.
+func (c *Coordinator) start() {
+	j, entries, err := openJournal(JournalFilename)
+	if err != nil {
+		log.Fatalf("cannot open %v: %v", JournalFilename, err)
 	}
 
-	c := Coordinator{tasks: tasks}
+	c.journal = j
+
+	if c.replay(entries) {
+		log.Printf("resuming from %v", JournalFilename)
+
+		if len(c.jobs) > 0 && c.allJobsFinished() {
+			c.completedAt = time.Now()
+		}
+	} else if len(entries) > 0 {
+		log.Printf("%v belongs to another job, starting over", JournalFilename)
+	}
+
+	// start from a clean journal that also identifies this job.
+	c.compact()
+
 	c.server()
-	return &c
+	go c.monitor()
 }
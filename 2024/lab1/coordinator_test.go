@@ -0,0 +1,494 @@
+package mr
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// the task GetTask hands the worker. tests only ask when one is ready.
+func getTask(t *testing.T, c *Coordinator, workerId int) ITask {
+	t.Helper()
+
+	reply := GetTaskReply{}
+	if err := c.GetTask(&GetTaskArgs{WorkerId: workerId}, &reply); err != nil {
+		t.Fatal(err)
+	}
+
+	return reply.Task
+}
+
+// report an attempt as done, with the given outputs; returns whether
+// the coordinator accepted it.
+func completeTask(t *testing.T, c *Coordinator, workerId int, task ITask, outputs ...OutputFile) bool {
+	t.Helper()
+
+	args := CompleteTaskArgs{WorkerId: workerId, Task: task, Outputs: outputs}
+	reply := CompleteTaskReply{}
+
+	if err := c.CompleteTask(&args, &reply); err != nil {
+		t.Fatal(err)
+	}
+
+	return reply.Ack
+}
+
+func heartbeat(t *testing.T, c *Coordinator, workerId int, task ITask) HeartbeatReply {
+	t.Helper()
+
+	reply := HeartbeatReply{}
+	if err := c.Heartbeat(&HeartbeatArgs{WorkerId: workerId, Task: task}, &reply); err != nil {
+		t.Fatal(err)
+	}
+
+	return reply
+}
+
+// a file as an attempt would leave it for the coordinator to commit.
+func attemptOutput(t *testing.T, name string) OutputFile {
+	t.Helper()
+
+	file, err := createTemp(name, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	return OutputFile{TempName: file.Name(), FinalName: name}
+}
+
+func TestExitOfUnregisteredWorker(t *testing.T) {
+	c := newCoordinator()
+
+	args := CompleteTaskArgs{WorkerId: 0, Task: &ExitTask{Task: Task{Type: Exit}}}
+	reply := CompleteTaskReply{}
+
+	if err := c.CompleteTask(&args, &reply); err != nil || !reply.Ack {
+		t.Fatalf("exit of a worker that never registered: ack %v, error %v", reply.Ack, err)
+	}
+}
+
+// jobs number their tasks alike, but neither their tasks nor their
+// files mix.
+func TestJobNamespacing(t *testing.T) {
+	spec := JobSpec{Files: []string{"in-0"}, Stages: []Stage{{NReduce: 1}}}
+	c := testCoordinator(t, spec)
+
+	reply := SubmitJobReply{}
+	if err := c.SubmitJob(&SubmitJobArgs{Spec: spec}, &reply); err != nil || reply.JobId != 1 {
+		t.Fatalf("submit got job %d, error %v, want job 1", reply.JobId, err)
+	}
+
+	first, second := getTask(t, c, 1), getTask(t, c, 2)
+
+	if first.GetJob() != 0 || second.GetJob() != 1 || first.GetId() != second.GetId() {
+		t.Fatalf("got map tasks %+v and %+v, want the same task of jobs 0 and 1", first, second)
+	}
+
+	filename := intermediateFilename(1, "", 0, 0)
+	if filename == intermediateFilename(0, "", 0, 0) {
+		t.Fatalf("jobs 0 and 1 share intermediate file %v", filename)
+	}
+
+	args := CompleteTaskArgs{WorkerId: 2, Task: second, IntermediateFilenames: []string{filename}}
+	if err := c.CompleteTask(&args, &CompleteTaskReply{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.jobs[0].getTask("", Map, 0).IsCompleted() || !c.jobs[1].getTask("", Map, 0).IsCompleted() {
+		t.Fatalf("completing the map task of job 1 did not complete it alone")
+	}
+
+	if got := c.jobs[1].getTask("", Reduce, 0).(*ReduceTask).InputFilenames; len(got) != 1 || got[0] != filename {
+		t.Fatalf("reduce task of job 1 reads %v, want %v", got, filename)
+	}
+
+	if got := c.jobs[0].getTask("", Reduce, 0).(*ReduceTask).InputFilenames; len(got) != 0 {
+		t.Fatalf("reduce task of job 0 reads %v", got)
+	}
+}
+
+func TestCancelJob(t *testing.T) {
+	chdirTemp(t)
+
+	spec := JobSpec{Files: []string{"in-0"}, Stages: []Stage{{NReduce: 1}}}
+	c := testCoordinator(t, spec)
+	j1 := submitTestJob(t, c, spec)
+
+	running := getTask(t, c, 1)
+
+	if err := c.CancelJob(&CancelJobArgs{JobId: 0}, &CancelJobReply{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// its running attempt is told to stop, its tasks are no longer
+	// handed out, and its late output is thrown away.
+	if reply := heartbeat(t, c, 1, running); !reply.Cancel {
+		t.Fatalf("running attempt of a cancelled job not told to stop")
+	}
+
+	if task := getTask(t, c, 2); task.GetJob() != 1 {
+		t.Fatalf("got %+v after cancelling job 0, want a task of job 1", task)
+	}
+
+	output := attemptOutput(t, "mr-out-0")
+
+	if completeTask(t, c, 1, running, output) {
+		t.Fatalf("attempt of a cancelled job accepted")
+	}
+
+	if _, err := os.Stat(output.TempName); !os.IsNotExist(err) {
+		t.Fatalf("output of a cancelled job left behind: %v", err)
+	}
+
+	if _, err := os.Stat(output.FinalName); !os.IsNotExist(err) {
+		t.Fatalf("output of a cancelled job committed: %v", err)
+	}
+
+	// cancelling again is harmless, cancelling a finished job is not.
+	if err := c.CancelJob(&CancelJobArgs{JobId: 0}, &CancelJobReply{}); err != nil {
+		t.Fatalf("cancelling a cancelled job: %v", err)
+	}
+
+	c.finish(j1, JobSucceeded)
+
+	if err := c.CancelJob(&CancelJobArgs{JobId: 1}, &CancelJobReply{}); err == nil {
+		t.Fatalf("cancelled a job that succeeded")
+	}
+
+	if state := c.jobs[0].state; state != JobCancelled {
+		t.Fatalf("job 0 is %s, want cancelled", state)
+	}
+}
+
+// a draining worker finishes its attempt, gets no more tasks, and stays
+// gone after it exits.
+func TestDrainWorker(t *testing.T) {
+	c := testCoordinator(t, JobSpec{Files: []string{"in-0", "in-1"}, Stages: []Stage{{NReduce: 1}}})
+
+	if err := c.DrainWorker(&DrainWorkerArgs{WorkerId: 1}, &DrainWorkerReply{}); err == nil {
+		t.Fatalf("drained a worker that is not there")
+	}
+
+	running := getTask(t, c, 1)
+
+	if err := c.DrainWorker(&DrainWorkerArgs{WorkerId: 1}, &DrainWorkerReply{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if reply := heartbeat(t, c, 1, running); !reply.Ack || reply.Cancel {
+		t.Fatalf("draining worker lost its attempt: %+v", reply)
+	}
+
+	if !completeTask(t, c, 1, running) {
+		t.Fatalf("attempt of a draining worker rejected")
+	}
+
+	exit := getTask(t, c, 1)
+	if !exit.Is(Exit) {
+		t.Fatalf("draining worker got %+v, want to exit", exit)
+	}
+
+	if task := getTask(t, c, 2); !task.Is(Map) {
+		t.Fatalf("other worker got %+v, want the other map task", task)
+	}
+
+	completeTask(t, c, 1, exit)
+
+	// a heartbeat that was on its way when it exited.
+	heartbeat(t, c, 1, nil)
+
+	if worker, ok := c.workers[1]; !ok || !worker.Exited || !worker.Draining {
+		t.Fatalf("drained worker came back as %+v", worker)
+	}
+}
+
+// a worker that stops sending heartbeats loses its attempt, which
+// counts as failed, and the task goes to another worker.
+func TestExpiredLease(t *testing.T) {
+	c := testCoordinator(t, JobSpec{Files: []string{"in-0"}, Stages: []Stage{{NReduce: 1}}})
+
+	first := getTask(t, c, 1)
+
+	c.expireLeases(time.Now())
+	if task := c.jobs[0].getTask("", Map, 0); task.GetFailures() != 0 {
+		t.Fatalf("lease expired before its time: %+v", task)
+	}
+
+	c.expireLeases(time.Now().Add(2 * LeaseTimeout))
+
+	task := c.jobs[0].getTask("", Map, 0)
+	if task.GetFailures() != 1 || task.GetError() != "lease of worker 1 expired" || len(task.GetLeases()) != 0 {
+		t.Fatalf("task with an expired lease is %+v", task)
+	}
+
+	if reply := heartbeat(t, c, 1, first); reply.Ack {
+		t.Fatalf("lease renewed after it expired")
+	}
+
+	second := getTask(t, c, 2)
+	if !second.Equals(first) || second.GetAttempt() != 2 {
+		t.Fatalf("got %+v, want attempt 2 of %+v", second, first)
+	}
+
+	// the expired attempt still counts if it is done first.
+	if !completeTask(t, c, 1, first) || task.GetCommittedAttempt() != 1 {
+		t.Fatalf("late attempt that finished first rejected")
+	}
+}
+
+// only the first attempt to finish is committed. later attempts,
+// repeated completions and attempts that never were leave the
+// committed output alone, and their own files are removed.
+func TestStaleAndDuplicateCompletions(t *testing.T) {
+	chdirTemp(t)
+
+	c := testCoordinator(t, JobSpec{Files: []string{"in-0"}, Stages: []Stage{{NReduce: 0}}})
+
+	first := getTask(t, c, 1)
+	c.expireLeases(time.Now().Add(2 * LeaseTimeout))
+	second := getTask(t, c, 2)
+
+	unknown := second.Clone().(*MapTask)
+	unknown.Attempt = 5
+
+	output := func(contents string) OutputFile {
+		output := attemptOutput(t, "mr-out-0")
+		if err := os.WriteFile(output.TempName, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return output
+	}
+
+	if completeTask(t, c, 1, unknown, output("unknown")) {
+		t.Fatalf("unknown attempt accepted")
+	}
+
+	if !completeTask(t, c, 2, second, output("second")) {
+		t.Fatalf("first attempt to finish rejected")
+	}
+
+	rejected := []OutputFile{output("first"), output("second again")}
+
+	if completeTask(t, c, 1, first, rejected[0]) {
+		t.Fatalf("stale attempt accepted")
+	}
+
+	if completeTask(t, c, 2, second, rejected[1]) {
+		t.Fatalf("duplicate completion accepted")
+	}
+
+	if data, err := os.ReadFile("mr-out-0"); err != nil || string(data) != "second" {
+		t.Fatalf("committed output is %q, %v, want that of the second attempt", data, err)
+	}
+
+	if task := c.jobs[0].getTask("", Map, 0); task.GetCommittedAttempt() != 2 {
+		t.Fatalf("committed attempt %d, want 2", task.GetCommittedAttempt())
+	}
+
+	checkNoTempFiles(t)
+}
+
+// near the end of a phase, an idle worker gets a backup attempt of the
+// slowest task. the first attempt to finish wins, and the other one is
+// told to stop.
+func TestBackupAttempt(t *testing.T) {
+	c := testCoordinator(t, JobSpec{Files: []string{"in-0", "in-1", "in-2", "in-3", "in-4"}, Stages: []Stage{{NReduce: 1}}})
+	j := c.jobs[0]
+
+	var tasks []ITask
+	for worker := 1; worker <= 5; worker++ {
+		tasks = append(tasks, getTask(t, c, worker))
+	}
+
+	for i, task := range tasks[:4] {
+		completeTask(t, c, i+1, task)
+	}
+
+	// the last map task has been running for much longer than the
+	// others took.
+	straggler := j.getTask("", Map, tasks[4].GetId()).(*MapTask)
+	straggler.Leases[0].StartedAt = time.Now().Add(-time.Hour)
+
+	if task := j.backupTask(5, c.speculationThreshold); task != nil {
+		t.Fatalf("backup of %+v on the worker running it", task)
+	}
+
+	backup := getTask(t, c, 6)
+	if !backup.Equals(straggler) || backup.GetAttempt() != 2 {
+		t.Fatalf("got %+v, want a backup of %+v", backup, straggler)
+	}
+
+	if task := j.backupTask(7, c.speculationThreshold); task != nil {
+		t.Fatalf("second backup of %+v", task)
+	}
+
+	if !completeTask(t, c, 6, backup) {
+		t.Fatalf("backup attempt rejected")
+	}
+
+	if reply := heartbeat(t, c, 5, tasks[4]); !reply.Cancel {
+		t.Fatalf("losing attempt not told to stop")
+	}
+
+	if completeTask(t, c, 5, tasks[4]) {
+		t.Fatalf("losing attempt accepted")
+	}
+}
+
+// the reduce tasks of a stage wait for its map tasks, and the map tasks
+// of a stage for the stages it reads.
+func TestStageGating(t *testing.T) {
+	c := testCoordinator(t, JobSpec{Files: []string{"in-0"}, Stages: []Stage{
+		{Name: "first", NReduce: 2},
+		{Name: "second", NReduce: 1, Inputs: []string{"first"}},
+	}})
+	j := c.jobs[0]
+
+	mapTask := getTask(t, c, 1)
+	if !mapTask.Is(Map) || mapTask.GetStage() != "first" {
+		t.Fatalf("got %+v, want the map task of the first stage", mapTask)
+	}
+
+	if task := j.readyTask(); task != nil {
+		t.Fatalf("%+v ready while the first map task runs", task)
+	}
+
+	args := CompleteTaskArgs{WorkerId: 1, Task: mapTask, IntermediateFilenames: []string{intermediateFilename(0, "first", 0, 0), intermediateFilename(0, "first", 0, 1)}}
+	if err := c.CompleteTask(&args, &CompleteTaskReply{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var reduceTasks []ITask
+	for worker := 1; worker <= 2; worker++ {
+		task := getTask(t, c, worker)
+		if !task.Is(Reduce) || task.GetStage() != "first" {
+			t.Fatalf("got %+v, want a reduce task of the first stage", task)
+		}
+
+		reduceTasks = append(reduceTasks, task)
+	}
+
+	completeTask(t, c, 1, reduceTasks[0])
+
+	if task := j.readyTask(); task != nil {
+		t.Fatalf("%+v ready before the first stage is done", task)
+	}
+
+	completeTask(t, c, 2, reduceTasks[1])
+
+	task := getTask(t, c, 1)
+	if !task.Is(Map) || task.GetStage() != "second" {
+		t.Fatalf("got %+v, want a map task of the second stage", task)
+	}
+
+	if filename := task.(*MapTask).Filename; filename != j.outputFilename("first", 0) {
+		t.Fatalf("second stage maps %v, want the output of the first", filename)
+	}
+}
+
+func failTask(t *testing.T, c *Coordinator, workerId int, task ITask, reason string, record *BadRecord) {
+	t.Helper()
+
+	args := FailTaskArgs{WorkerId: workerId, Task: task, Reason: reason, BadRecord: record}
+	if err := c.FailTask(&args, &FailTaskReply{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// a task that fails MaxAttempts times fails its job.
+func TestBoundedRetries(t *testing.T) {
+	c := testCoordinator(t, JobSpec{Files: []string{"in-0"}, Stages: []Stage{{NReduce: 1}}, MaxAttempts: 2})
+	j := c.jobs[0]
+
+	first := getTask(t, c, 1)
+	failTask(t, c, 1, first, "cannot open in-0", nil)
+
+	// reported twice, counted once.
+	failTask(t, c, 1, first, "cannot open in-0", nil)
+
+	if j.state == JobFailed {
+		t.Fatalf("job failed after one failed attempt of two")
+	}
+
+	second := getTask(t, c, 2)
+	if !second.Equals(first) || second.GetAttempt() != 2 {
+		t.Fatalf("got %+v, want attempt 2 of %+v", second, first)
+	}
+
+	failTask(t, c, 2, second, "cannot open in-0", nil)
+
+	status := j.status()
+	if status.State != JobFailed || status.Error != "map task 0 (in-0) failed 2 times: cannot open in-0" {
+		t.Fatalf("job is %s with error %q", status.State, status.Error)
+	}
+
+	if testCoordinator(t, JobSpec{Files: []string{"in-0"}, Stages: []Stage{{NReduce: 1}}}).jobs[0].maxAttempts() != DefaultMaxAttempts {
+		t.Fatalf("zero MaxAttempts is not DefaultMaxAttempts")
+	}
+}
+
+// a job that skips bad inputs gives up on map tasks that keep failing,
+// and goes on without their output, but not on reduce tasks.
+func TestSkipBadInputs(t *testing.T) {
+	c := testCoordinator(t, JobSpec{Files: []string{"in-0", "in-1"}, Stages: []Stage{{NReduce: 1}}, MaxAttempts: 2, OnFailure: SkipBadInputs})
+	j := c.jobs[0]
+
+	bad, good := getTask(t, c, 1), getTask(t, c, 2)
+	failTask(t, c, 1, bad, "cannot open in-0", nil)
+	failTask(t, c, 1, getTask(t, c, 1), "cannot open in-0", nil)
+
+	if !j.getTask("", Map, bad.GetId()).IsSkipped() || j.state == JobFailed {
+		t.Fatalf("map task that kept failing was not skipped")
+	}
+
+	filename := intermediateFilename(0, "", good.GetId(), 0)
+
+	args := CompleteTaskArgs{WorkerId: 2, Task: good, IntermediateFilenames: []string{filename}}
+	if err := c.CompleteTask(&args, &CompleteTaskReply{}); err != nil {
+		t.Fatal(err)
+	}
+
+	reduce := getTask(t, c, 1)
+	if got := reduce.(*ReduceTask).InputFilenames; len(got) != 1 || got[0] != filename {
+		t.Fatalf("reduce task reads %v, want only the output of the good map task", got)
+	}
+
+	if status := j.status(); len(status.Skipped) != 1 {
+		t.Fatalf("job reports %v skipped, want the bad map task", status.Skipped)
+	}
+
+	failTask(t, c, 1, reduce, "cannot read input", nil)
+	failTask(t, c, 1, getTask(t, c, 1), "cannot read input", nil)
+
+	if j.state != JobFailed {
+		t.Fatalf("job with a failed reduce task is %s", j.state)
+	}
+}
+
+// in jobs that skip bad records, later attempts of a task leave out the
+// records earlier attempts panicked on.
+func TestSkipBadRecords(t *testing.T) {
+	for _, skip := range []bool{false, true} {
+		c := testCoordinator(t, JobSpec{Files: []string{"in-0"}, Stages: []Stage{{NReduce: 1}}, SkipBadRecords: skip})
+
+		failTask(t, c, 1, getTask(t, c, 1), "panic: bad record", &BadRecord{Index: 3, Key: "in-0"})
+
+		mapTask := getTask(t, c, 1).(*MapTask)
+		if got := len(mapTask.SkipRecords) == 1 && mapTask.SkipRecords[0] == 3; got != skip {
+			t.Fatalf("skipping %v: next map attempt skips %v", skip, mapTask.SkipRecords)
+		}
+
+		args := CompleteTaskArgs{WorkerId: 1, Task: mapTask, IntermediateFilenames: []string{intermediateFilename(0, "", 0, 0)}}
+		if err := c.CompleteTask(&args, &CompleteTaskReply{}); err != nil {
+			t.Fatal(err)
+		}
+
+		failTask(t, c, 1, getTask(t, c, 1), "panic: bad key", &BadRecord{Key: "k"})
+
+		reduceTask := getTask(t, c, 1).(*ReduceTask)
+		if got := len(reduceTask.SkipKeys) == 1 && reduceTask.SkipKeys[0] == "k"; got != skip {
+			t.Fatalf("skipping %v: next reduce attempt skips %v", skip, reduceTask.SkipKeys)
+		}
+	}
+}
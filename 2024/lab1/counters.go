@@ -0,0 +1,40 @@
+package mr
+
+import "sync"
+
+// counters maintained by the framework itself.
+const (
+	// records that went into, and came out of, the combiner.
+	CombineInputRecords  = "combine input records"
+	CombineOutputRecords = "combine output records"
+)
+
+// counters of the attempt the worker is running. they travel to the
+// coordinator with CompleteTask, which only adds them to the job's
+// totals if it accepts the attempt.
+var (
+	countersMutex sync.Mutex
+	taskCounters  = make(map[string]int64)
+)
+
+// add delta to the counter called name. Map and Reduce functions call
+// this to count whatever is of interest about a job, such as malformed
+// records they skipped; the totals are logged when the job finishes,
+// and returned by JobStatus.
+func IncrCounter(name string, delta int64) {
+	countersMutex.Lock()
+	defer countersMutex.Unlock()
+
+	taskCounters[name] += delta
+}
+
+// return the counters of the current attempt and start over.
+func takeCounters() map[string]int64 {
+	countersMutex.Lock()
+	defer countersMutex.Unlock()
+
+	counters := taskCounters
+	taskCounters = make(map[string]int64)
+
+	return counters
+}
@@ -0,0 +1,275 @@
+package mr
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// an InputFormat turns the split of a map task into the records Map is
+// called with; an OutputFormat writes what Reduce returns. both are
+// chosen per job with WithInputFormat and WithOutputFormat.
+
+type InputFormat interface {
+	// call emit with the key and value of every record of the split
+	// of filename that starts at offset and is read from r.
+	Read(filename string, offset int64, r io.Reader, emit func(key, value string)) error
+	// where records may start in a file, so that splits don't cut
+	// records in two. nil if files can only be read whole.
+	Boundary() RecordBoundary
+}
+
+type OutputFormat interface {
+	NewWriter(w io.Writer) (KVEncoder, error)
+}
+
+var (
+	formatsMutex sync.Mutex
+	inputFormats = map[string]InputFormat{
+		"file":       FileInputFormat{},
+		"lines":      LineInputFormat{},
+		"json-lines": JSONLinesInputFormat{},
+		"csv":        CSVInputFormat{},
+		"binary":     BinaryInputFormat{},
+	}
+	outputFormats = map[string]OutputFormat{
+		"text":       TextOutputFormat{},
+		"json-lines": JSONLinesOutputFormat{},
+		"binary":     BinaryOutputFormat{},
+	}
+)
+
+// make an input format available to jobs under name.
+func RegisterInputFormat(name string, format InputFormat) {
+	formatsMutex.Lock()
+	defer formatsMutex.Unlock()
+
+	inputFormats[name] = format
+}
+
+// make an output format available to jobs under name.
+func RegisterOutputFormat(name string, format OutputFormat) {
+	formatsMutex.Lock()
+	defer formatsMutex.Unlock()
+
+	outputFormats[name] = format
+}
+
+// empty name means "file".
+func lookupInputFormat(name string) (InputFormat, error) {
+	formatsMutex.Lock()
+	defer formatsMutex.Unlock()
+
+	if name == "" {
+		name = "file"
+	}
+
+	format, ok := inputFormats[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown input format %q", name)
+	}
+
+	return format, nil
+}
+
+// empty name means "text".
+func lookupOutputFormat(name string) (OutputFormat, error) {
+	formatsMutex.Lock()
+	defer formatsMutex.Unlock()
+
+	if name == "" {
+		name = "text"
+	}
+
+	format, ok := outputFormats[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown output format %q", name)
+	}
+
+	return format, nil
+}
+
+// the whole split is one record, keyed by the file name.
+type FileInputFormat struct{}
+
+func (FileInputFormat) Read(filename string, offset int64, r io.Reader, emit func(key, value string)) error {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	emit(filename, string(content))
+
+	return nil
+}
+
+func (FileInputFormat) Boundary() RecordBoundary {
+	return NewlineBoundary
+}
+
+// every line is a record, keyed by its offset in the file.
+type LineInputFormat struct{}
+
+func (LineInputFormat) Read(filename string, offset int64, r io.Reader, emit func(key, value string)) error {
+	return readLines(offset, r, func(offset int64, line []byte) error {
+		emit(strconv.FormatInt(offset, 10), string(line))
+		return nil
+	})
+}
+
+func (LineInputFormat) Boundary() RecordBoundary {
+	return NewlineBoundary
+}
+
+// call f with every line of r and its offset, without the line end.
+func readLines(offset int64, r io.Reader, f func(offset int64, line []byte) error) error {
+	br := bufio.NewReader(r)
+
+	for {
+		line, err := br.ReadBytes('\n')
+
+		if len(line) > 0 {
+			n := int64(len(line))
+			line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+
+			if ferr := f(offset, line); ferr != nil {
+				return ferr
+			}
+
+			offset += n
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// every line is a JSON KeyValue, as written by JSONLinesOutputFormat.
+type JSONLinesInputFormat struct{}
+
+func (JSONLinesInputFormat) Read(filename string, offset int64, r io.Reader, emit func(key, value string)) error {
+	return readLines(offset, r, func(offset int64, line []byte) error {
+		if len(bytes.TrimSpace(line)) == 0 {
+			return nil
+		}
+
+		var kv KeyValue
+		if err := json.Unmarshal(line, &kv); err != nil {
+			return fmt.Errorf("%v at offset %d: %v", filename, offset, err)
+		}
+
+		emit(kv.Key, kv.Value)
+
+		return nil
+	})
+}
+
+func (JSONLinesInputFormat) Boundary() RecordBoundary {
+	return NewlineBoundary
+}
+
+// every row is a record, keyed by its first field. the value holds the
+// remaining fields, CSV encoded. quoted fields may not span lines,
+// since splits end at line ends.
+type CSVInputFormat struct{}
+
+func (CSVInputFormat) Read(filename string, offset int64, r io.Reader, emit func(key, value string)) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	for {
+		record, err := reader.Read()
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("%v: %v", filename, err)
+		}
+
+		var value strings.Builder
+		writer := csv.NewWriter(&value)
+		writer.Write(record[1:])
+		writer.Flush()
+
+		emit(record[0], strings.TrimSuffix(value.String(), "\n"))
+	}
+}
+
+func (CSVInputFormat) Boundary() RecordBoundary {
+	return NewlineBoundary
+}
+
+// reads files written by BinaryOutputFormat, or by any codec.
+// such files cannot be split.
+type BinaryInputFormat struct{}
+
+func (BinaryInputFormat) Read(filename string, offset int64, r io.Reader, emit func(key, value string)) error {
+	dec, err := newKVDecoder(r)
+	if err != nil {
+		return fmt.Errorf("%v: %v", filename, err)
+	}
+
+	for {
+		var kv KeyValue
+
+		if err := dec.Decode(&kv); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%v: %v", filename, err)
+		}
+
+		emit(kv.Key, kv.Value)
+	}
+}
+
+func (BinaryInputFormat) Boundary() RecordBoundary {
+	return nil
+}
+
+// "key value" lines.
+type TextOutputFormat struct{}
+
+type textWriter struct {
+	w io.Writer
+}
+
+func (TextOutputFormat) NewWriter(w io.Writer) (KVEncoder, error) {
+	return &textWriter{w: w}, nil
+}
+
+func (t *textWriter) Encode(kv *KeyValue) error {
+	// this is the correct format for each line of Reduce output.
+	_, err := fmt.Fprintf(t.w, "%v %v\n", kv.Key, kv.Value)
+	return err
+}
+
+func (t *textWriter) Close() error {
+	return nil
+}
+
+// one JSON KeyValue per line, readable by JSONLinesInputFormat.
+type JSONLinesOutputFormat struct{}
+
+func (JSONLinesOutputFormat) NewWriter(w io.Writer) (KVEncoder, error) {
+	return jsonCodec{}.NewEncoder(w), nil
+}
+
+// the binary codec of intermediate files, readable by BinaryInputFormat.
+type BinaryOutputFormat struct{}
+
+func (BinaryOutputFormat) NewWriter(w io.Writer) (KVEncoder, error) {
+	return newKVEncoder(w, "binary")
+}
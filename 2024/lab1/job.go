@@ -0,0 +1,465 @@
+package mr
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+)
+
+// a coordinator runs any number of jobs side by side, sharing its
+// workers between them. every job has its own tasks, and its files are
+// named after its id so that jobs never see each other's files. the
+// job passed to MakeCoordinator has id 0 and keeps the plain mr-X-Y
+// and mr-out-Y names.
+
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobCancelled JobState = "cancelled"
+	JobFailed    JobState = "failed"
+)
+
+// what becomes of a task once MaxAttempts of its attempts failed.
+type FailurePolicy string
+
+const (
+	// the job fails.
+	FailFast FailurePolicy = "fail"
+	// map tasks are skipped, and the job goes on without their input.
+	// reduce tasks still fail the job.
+	SkipBadInputs FailurePolicy = "skip"
+)
+
+// attempts of a task that may fail, unless the job says otherwise. it
+// is generous, so that workers that crash now and then for reasons of
+// their own don't fail jobs.
+const DefaultMaxAttempts = 10
+
+// what a job runs: the stages of a pipeline over its input files.
+type JobSpec struct {
+	Files       []string
+	Stages      []Stage
+	Partitioner PartitionerConfig
+	// codec of the intermediate files. empty means DefaultCodec.
+	Codec string
+	// cut input files into splits of about this many bytes. zero
+	// maps every file in a single task.
+	SplitSize int64
+	// an attempt fails if its worker reports an error or a panic, or
+	// stops sending heartbeats. zero means DefaultMaxAttempts.
+	MaxAttempts int
+	// empty means FailFast.
+	OnFailure FailurePolicy
+	// leave out records that map and reduce functions panic on,
+	// see skip.go.
+	SkipBadRecords bool
+}
+
+func (s JobSpec) equal(other JobSpec) bool {
+	return slices.Equal(s.Files, other.Files) && slices.EqualFunc(s.Stages, other.Stages, Stage.equal) &&
+		s.Partitioner.equal(other.Partitioner) && s.Codec == other.Codec && s.SplitSize == other.SplitSize &&
+		s.MaxAttempts == other.MaxAttempts && s.OnFailure == other.OnFailure && s.SkipBadRecords == other.SkipBadRecords
+}
+
+// the order in which jobs get to hand out their tasks.
+type SchedulingPolicy string
+
+const (
+	// the oldest job with a task to hand out goes first.
+	FIFO SchedulingPolicy = "fifo"
+	// the job with the fewest running attempts goes first,
+	// so that every job gets its share of the workers.
+	FairShare SchedulingPolicy = "fair"
+)
+
+type job struct {
+	id    int
+	spec  JobSpec
+	state JobState
+	tasks []ITask
+	// final names of the files of every committed map task,
+	// indexed by map task id and then by reduce partition.
+	intermediates map[int][]string
+	// totals of the counters of all accepted attempts.
+	counters map[string]int64
+	// the counters of every committed map task, indexed by map task
+	// id. they are lost along with the task's output.
+	mapCounters map[int]map[string]int64
+	submittedAt time.Time
+	finishedAt  time.Time
+	// why the job failed.
+	failure string
+}
+
+// the file names of job id start with this.
+func jobPrefix(id int) string {
+	if id == 0 {
+		return "mr"
+	}
+
+	return fmt.Sprintf("mr-j%d", id)
+}
+
+// create a job and its tasks. boundary, if not nil, overrides
+// where the input formats of the stages split files.
+func newJob(id int, spec JobSpec, boundary RecordBoundary) (*job, error) {
+	if err := checkStages(spec.Stages); err != nil {
+		return nil, err
+	}
+
+	if spec.MaxAttempts < 0 {
+		return nil, errors.New("maxAttempts must not be negative")
+	}
+
+	if spec.OnFailure != "" && spec.OnFailure != FailFast && spec.OnFailure != SkipBadInputs {
+		return nil, fmt.Errorf("unknown failure policy %q", spec.OnFailure)
+	}
+
+	// every attempt would fail on these.
+	if _, err := lookupCodec(spec.Codec); err != nil {
+		return nil, err
+	}
+
+	if _, err := makePartitioner(spec.Partitioner); err != nil {
+		return nil, err
+	}
+
+	j := &job{
+		id:            id,
+		spec:          spec,
+		state:         JobQueued,
+		intermediates: make(map[int][]string),
+		counters:      make(map[string]int64),
+		mapCounters:   make(map[int]map[string]int64),
+		submittedAt:   time.Now(),
+	}
+
+	nMap := 0
+
+	for _, stage := range spec.Stages {
+		inputFormat, err := lookupInputFormat(stage.InputFormat)
+		if err != nil {
+			return nil, fmt.Errorf("stage %q: %v", stage.Name, err)
+		}
+
+		if _, err := lookupOutputFormat(stage.OutputFormat); err != nil {
+			return nil, fmt.Errorf("stage %q: %v", stage.Name, err)
+		}
+
+		stageBoundary := boundary
+		if stageBoundary == nil {
+			stageBoundary = inputFormat.Boundary()
+		}
+
+		mapTask := func(filename string, split split) {
+			task := &MapTask{
+				Task:        Task{Id: nMap, Type: Map, Job: id, Stage: stage.Name},
+				Filename:    filename,
+				Offset:      split.offset,
+				Length:      split.length,
+				NReduce:     stage.NReduce,
+				Partitioner: spec.Partitioner,
+				Codec:       spec.Codec,
+				InputFormat: stage.InputFormat,
+			}
+
+			if stage.NReduce == 0 {
+				task.OutputFilename = j.outputFilename(stage.Name, nMap)
+				task.OutputFormat = stage.OutputFormat
+			}
+
+			j.tasks = append(j.tasks, task)
+			nMap++
+		}
+
+		if len(stage.Inputs) > 0 {
+			// the output of earlier stages does not exist yet,
+			// so it cannot be split; every file is one task.
+			for _, input := range stage.Inputs {
+				for _, task := range j.tasks {
+					if task.GetStage() != input {
+						continue
+					}
+
+					switch task := task.(type) {
+					case *ReduceTask:
+						mapTask(task.OutputFilename, split{})
+					case *MapTask:
+						// map-only stages leave one file per map task.
+						if task.OutputFilename != "" {
+							mapTask(task.OutputFilename, split{})
+						}
+					}
+				}
+			}
+		} else {
+			for _, filename := range spec.Files {
+				splits := []split{{}}
+
+				if spec.SplitSize > 0 && stageBoundary != nil {
+					if splits, err = splitFile(filename, spec.SplitSize, stageBoundary); err != nil {
+						return nil, fmt.Errorf("cannot split %v: %v", filename, err)
+					}
+				}
+
+				for _, split := range splits {
+					mapTask(filename, split)
+				}
+			}
+		}
+
+		for i := 0; i < stage.NReduce; i++ {
+			j.tasks = append(j.tasks, &ReduceTask{
+				Task:           Task{Id: i, Type: Reduce, Job: id, Stage: stage.Name},
+				OutputFilename: j.outputFilename(stage.Name, i),
+				OutputFormat:   stage.OutputFormat,
+				Identity:       stage.IdentityReduce,
+			})
+		}
+	}
+
+	return j, nil
+}
+
+func (j *job) status() JobStatusReply {
+	status := JobStatusReply{
+		State:       j.state,
+		SubmittedAt: j.submittedAt,
+		FinishedAt:  j.finishedAt,
+		Counters:    make(map[string]int64, len(j.counters)),
+		Error:       j.failure,
+	}
+
+	for name, value := range j.counters {
+		status.Counters[name] = value
+	}
+
+	for _, task := range j.tasks {
+		if task.Is(Map) {
+			status.MapTasks++
+		} else {
+			status.ReduceTasks++
+		}
+
+		if task.IsCompleted() {
+			if task.Is(Map) {
+				status.CompletedMapTasks++
+			} else {
+				status.CompletedReduceTasks++
+			}
+		}
+
+		if task.IsSkipped() {
+			status.Skipped = append(status.Skipped, j.describeFailure(task))
+		}
+	}
+
+	return status
+}
+
+// which task failed, on what input, and why.
+func (j *job) describeFailure(task ITask) string {
+	description := fmt.Sprintf("%s task %d", task.GetType(), task.GetId())
+
+	if task.GetStage() != "" {
+		description = fmt.Sprintf("stage %s %s", task.GetStage(), description)
+	}
+
+	if task, ok := task.(*MapTask); ok {
+		description += fmt.Sprintf(" (%v", task.Filename)
+		if task.Length > 0 {
+			description += fmt.Sprintf(" at %d", task.Offset)
+		}
+		description += ")"
+	}
+
+	return fmt.Sprintf("%s failed %d times: %s", description, task.GetFailures(), task.GetError())
+}
+
+func (j *job) maxAttempts() int {
+	if j.spec.MaxAttempts == 0 {
+		return DefaultMaxAttempts
+	}
+
+	return j.spec.MaxAttempts
+}
+
+func (j *job) isFinished() bool {
+	return j.state == JobSucceeded || j.state == JobCancelled || j.state == JobFailed
+}
+
+// the first task of the job that can be handed out right now, if any.
+func (j *job) readyTask() ITask {
+	mapped, done := j.stageProgress()
+
+	for _, task := range j.tasks {
+		if task.IsCompleted() || task.IsScheduled() || !j.isReady(task, mapped, done) {
+			continue
+		}
+
+		return task
+	}
+
+	return nil
+}
+
+// a straggler of the job worth a backup attempt on workerId, if any.
+func (j *job) backupTask(workerId int, threshold float64) ITask {
+	mapped, done := j.stageProgress()
+
+	for _, stage := range j.spec.Stages {
+		if done[stage.Name] || !j.stageStarted(stage.Name, done) {
+			continue
+		}
+
+		phase := Reduce
+		if !mapped[stage.Name] {
+			phase = Map
+		}
+
+		if task := j.straggler(stage.Name, phase, workerId, threshold); task != nil {
+			return task
+		}
+	}
+
+	return nil
+}
+
+// near the end of a phase, the slowest running task of the phase is
+// worth a backup attempt on an otherwise idle worker: whichever attempt
+// finishes first is committed. returns nil if no task qualifies.
+func (j *job) straggler(stage string, phase TaskType, workerId int, threshold float64) ITask {
+	if threshold <= 0 {
+		return nil
+	}
+
+	var total, remaining int
+	var runtimes time.Duration
+
+	for _, task := range j.tasks {
+		if !task.Is(phase) || task.GetStage() != stage {
+			continue
+		}
+
+		total++
+
+		if task.IsCompleted() {
+			runtimes += task.GetRuntime()
+		} else {
+			remaining++
+		}
+	}
+
+	// without a completed task there is nothing to compare against.
+	if remaining == 0 || remaining == total || float64(remaining) > max(1, threshold*float64(total)) {
+		return nil
+	}
+
+	slow := SpeculationSlowdown * runtimes / time.Duration(total-remaining)
+
+	var slowest ITask
+	var slowestStart time.Time
+
+	for _, task := range j.tasks {
+		if !task.Is(phase) || task.GetStage() != stage || task.IsCompleted() {
+			continue
+		}
+
+		leases := task.GetLeases()
+
+		// one backup per task, and never on the worker already running it.
+		if len(leases) != 1 || leases[0].WorkerId == workerId || time.Since(leases[0].StartedAt) < slow {
+			continue
+		}
+
+		if slowest == nil || leases[0].StartedAt.Before(slowestStart) {
+			slowest = task
+			slowestStart = leases[0].StartedAt
+		}
+	}
+
+	if slowest != nil {
+		log.Printf("launching a backup attempt of job %d %s task %d on worker %d", j.id, phase, slowest.GetId(), workerId)
+	}
+
+	return slowest
+}
+
+// attempts of the job that are running right now.
+func (j *job) running() int {
+	n := 0
+
+	for _, task := range j.tasks {
+		n += len(task.GetLeases())
+	}
+
+	return n
+}
+
+// hand the files of a committed map task to the reduce tasks
+// of their partitions.
+func (j *job) recordIntermediates(stage string, mapId int, filenames []string) {
+	j.intermediates[mapId] = filenames
+
+	for reduceId, filename := range filenames {
+		if filename == "" {
+			continue
+		}
+
+		if task, ok := j.getTask(stage, Reduce, reduceId).(*ReduceTask); ok {
+			task.InputFilenames = append(task.InputFilenames, filename)
+		} else {
+			log.Printf("no reduce task for intermediate file %v", filename)
+		}
+	}
+}
+
+func (j *job) getTask(stage string, taskType TaskType, id int) ITask {
+	for _, t := range j.tasks {
+		if t.Is(taskType) && t.GetId() == id && t.GetStage() == stage {
+			return t
+		}
+	}
+
+	return nil
+}
+
+func (j *job) allTasksCompleted() bool {
+	for _, task := range j.tasks {
+		if !task.IsCompleted() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// only accepted attempts count, so a retried
+// task is never counted twice. task may be nil
+// for counters that belong to no task in particular.
+func (j *job) addCounters(task ITask, counters map[string]int64) {
+	for name, delta := range counters {
+		j.counters[name] += delta
+	}
+
+	if task != nil && task.Is(Map) && len(counters) > 0 {
+		j.mapCounters[task.GetId()] = counters
+	}
+}
+
+// log the totals of the job's counters once it is done.
+func (j *job) reportCounters() {
+	for _, name := range sortedKeys(j.counters) {
+		log.Printf("job %d counter %q: %d", j.id, name, j.counters[name])
+	}
+
+	if in := j.counters[CombineInputRecords]; in > 0 {
+		out := j.counters[CombineOutputRecords]
+		log.Printf("combiner cut map output of job %d from %d to %d records (%.1f%% saved)", j.id, in, out, 100*float64(in-out)/float64(in))
+	}
+}
@@ -0,0 +1,430 @@
+package mr
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// the coordinator journals every job and task state transition, so that
+// a restarted coordinator can pick its jobs up where the old one left them.
+const JournalFilename = "mr-coordinator.journal"
+
+// the journal is rewritten from the coordinator's state
+// after this many appended entries.
+const JournalCompactThreshold = 1000
+
+type JournalOp string
+
+const (
+	// a job was submitted. the job of MakeCoordinator
+	// comes first and identifies the journal.
+	OpJob JournalOp = "job"
+	// a job was cancelled.
+	OpCancelled JournalOp = "cancelled"
+	// a worker was handed an id.
+	OpRegistered JournalOp = "registered"
+	// a new attempt of a task was handed out.
+	OpScheduled JournalOp = "scheduled"
+	// an attempt was accepted and its outputs committed.
+	OpCompleted JournalOp = "completed"
+	// an attempt failed.
+	OpFailed JournalOp = "failed"
+	// counter totals, written by compaction in place of the
+	// counters of the compacted OpCompleted entries of reduce tasks.
+	OpCounters JournalOp = "counters"
+)
+
+type JournalEntry struct {
+	Op JournalOp
+	// every op but OpRegistered
+	Job int `json:",omitempty"`
+
+	// OpJob
+	Spec *JobSpec `json:",omitempty"`
+
+	// OpRegistered
+	WorkerId int `json:",omitempty"`
+
+	// OpScheduled, OpCompleted and OpFailed
+	Stage                 string   `json:",omitempty"`
+	Type                  TaskType `json:",omitempty"`
+	Id                    int      `json:",omitempty"`
+	Attempt               int      `json:",omitempty"`
+	IntermediateFilenames []string `json:",omitempty"`
+
+	// OpCompleted, per task, and OpCounters, per job
+	Counters map[string]int64 `json:",omitempty"`
+
+	// OpFailed. compaction folds the failures of a task into one
+	// entry with their count and the last reason, apart from those
+	// that left out a bad record.
+	Reason    string     `json:",omitempty"`
+	Failures  int        `json:",omitempty"`
+	BadRecord *BadRecord `json:",omitempty"`
+}
+
+type journal struct {
+	filename string
+	file     *os.File
+	enc      *json.Encoder
+	// entries appended since the last compaction.
+	appended int
+	// the job is over and the journal removed.
+	retired bool
+}
+
+// open the journal, creating it if needed, and return the entries it
+// already holds. a torn entry at the end, left by a crash in the middle
+// of a write, is ignored.
+func openJournal(filename string) (*journal, []JournalEntry, error) {
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var entries []JournalEntry
+	dec := json.NewDecoder(file)
+
+	for {
+		var entry JournalEntry
+		if err := dec.Decode(&entry); err != nil {
+			if err != io.EOF {
+				log.Printf("ignoring the rest of %v: %v", filename, err)
+			}
+			break
+		}
+		entries = append(entries, entry)
+	}
+
+	return &journal{filename: filename, file: file, enc: json.NewEncoder(file)}, entries, nil
+}
+
+// append an entry and make sure it is on disk before returning.
+func (j *journal) append(entry JournalEntry) error {
+	if err := j.enc.Encode(&entry); err != nil {
+		return err
+	}
+
+	j.appended++
+
+	return j.file.Sync()
+}
+
+// replace the whole journal with the given entries.
+func (j *journal) rewrite(entries []JournalEntry) error {
+	tmp, err := os.CreateTemp(filepath.Dir(j.filename), filepath.Base(j.filename)+"-*")
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(tmp)
+
+	for _, entry := range entries {
+		if err := enc.Encode(&entry); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), j.filename); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	// tmp is the journal now; keep appending to it.
+	j.file.Close()
+	j.file = tmp
+	j.enc = json.NewEncoder(tmp)
+	j.appended = 0
+
+	// without this, a crash may bring the old journal back, and
+	// lose what was appended to the new one in the meantime.
+	return syncDir(filepath.Dir(j.filename))
+}
+
+// remove the journal once its job is over, so that a coordinator
+// started later in the same directory runs the job afresh rather
+// than resuming it, possibly with other map and reduce functions.
+func (j *journal) retire() error {
+	if j.retired {
+		return nil
+	}
+
+	j.retired = true
+	j.file.Close()
+
+	if err := os.Remove(j.filename); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(j.filename))
+}
+
+// journal a state transition. the coordinator cannot safely go on
+// without its journal, so failures are fatal.
+func (c *Coordinator) record(entry JournalEntry) {
+	if c.journal.retired {
+		return
+	}
+
+	if err := c.journal.append(entry); err != nil {
+		log.Fatalf("cannot append to %v: %v", c.journal.filename, err)
+	}
+
+	if c.journal.appended >= JournalCompactThreshold {
+		c.compact()
+	}
+}
+
+// rewrite the journal as the shortest list of entries
+// that reproduces the current state.
+func (c *Coordinator) compact() {
+	if err := c.journal.rewrite(c.snapshot()); err != nil {
+		log.Fatalf("cannot compact %v: %v", c.journal.filename, err)
+	}
+}
+
+func (c *Coordinator) snapshot() []JournalEntry {
+	var entries []JournalEntry
+
+	for _, j := range c.jobs {
+		entries = append(entries, JournalEntry{Op: OpJob, Job: j.id, Spec: &j.spec})
+
+		if j.state == JobCancelled {
+			entries = append(entries, JournalEntry{Op: OpCancelled, Job: j.id})
+		}
+
+		// the counters of map tasks stay with their OpCompleted entries,
+		// so that replay drops them if the task has to run again.
+		totals := make(map[string]int64)
+
+		for name, value := range j.counters {
+			totals[name] = value
+		}
+
+		for _, counters := range j.mapCounters {
+			for name, value := range counters {
+				totals[name] -= value
+			}
+		}
+
+		for name, value := range totals {
+			if value == 0 {
+				delete(totals, name)
+			}
+		}
+
+		if len(totals) > 0 {
+			entries = append(entries, JournalEntry{Op: OpCounters, Job: j.id, Counters: totals})
+		}
+
+		for _, task := range j.tasks {
+			if task.GetAttempt() > 0 {
+				entries = append(entries, JournalEntry{Op: OpScheduled, Job: j.id, Stage: task.GetStage(), Type: task.GetType(), Id: task.GetId(), Attempt: task.GetAttempt()})
+			}
+		}
+
+		// replaying the failures skips the tasks they skipped,
+		// and fails the job if they failed it.
+		for _, task := range j.tasks {
+			failures := task.GetFailures()
+
+			for _, record := range skippedRecords(task) {
+				entries = append(entries, JournalEntry{Op: OpFailed, Job: j.id, Stage: task.GetStage(), Type: task.GetType(), Id: task.GetId(), Reason: task.GetError(), BadRecord: &record})
+				failures--
+			}
+
+			if failures > 0 {
+				entries = append(entries, JournalEntry{Op: OpFailed, Job: j.id, Stage: task.GetStage(), Type: task.GetType(), Id: task.GetId(), Reason: task.GetError(), Failures: failures})
+			}
+		}
+
+		// map tasks come before the reduce tasks of their stage in
+		// j.tasks, so their manifests are replayed before the reduce
+		// tasks that read them.
+		for _, task := range j.tasks {
+			if task.IsCompleted() && !task.IsSkipped() {
+				entries = append(entries, JournalEntry{
+					Op:      OpCompleted,
+					Job:     j.id,
+					Stage:   task.GetStage(),
+					Type:    task.GetType(),
+					Id:      task.GetId(),
+					Attempt: task.GetCommittedAttempt(),
+				})
+
+				if task.Is(Map) {
+					entries[len(entries)-1].IntermediateFilenames = j.intermediates[task.GetId()]
+					entries[len(entries)-1].Counters = j.mapCounters[task.GetId()]
+				}
+			}
+		}
+	}
+
+	if c.nextWorkerId > 0 {
+		entries = append(entries, JournalEntry{Op: OpRegistered, WorkerId: c.nextWorkerId})
+	}
+
+	return entries
+}
+
+// rebuild the state journaled by an earlier coordinator. returns false
+// if the journal belongs to a different job.
+func (c *Coordinator) replay(entries []JournalEntry) bool {
+	if len(entries) == 0 {
+		return false
+	}
+
+	// a coordinator made with a job of its own finds that job first in
+	// the journal, one without never finds it. task ids and map output
+	// are only meaningful for the very same job.
+	first := entries[0]
+	ownJob := first.Op == OpJob && first.Job == 0
+
+	if j := c.job(0); j != nil {
+		if !ownJob || first.Spec == nil || !first.Spec.equal(j.spec) {
+			return false
+		}
+	} else if ownJob {
+		return false
+	}
+
+	for _, entry := range entries {
+		switch entry.Op {
+		case OpJob:
+			if entry.Job == 0 || entry.Spec == nil {
+				continue
+			}
+
+			j, err := newJob(entry.Job, *entry.Spec, c.boundary)
+			if err != nil {
+				log.Printf("cannot resume job %d: %v", entry.Job, err)
+				continue
+			}
+
+			c.jobs = append(c.jobs, j)
+			c.nextJobId = max(c.nextJobId, j.id+1)
+
+		case OpCancelled:
+			if j := c.job(entry.Job); j != nil {
+				c.finish(j, JobCancelled)
+			}
+
+		case OpRegistered:
+			c.nextWorkerId = max(c.nextWorkerId, entry.WorkerId)
+
+		case OpScheduled:
+			// leases died with the old coordinator, so the task is simply
+			// up for grabs again. its attempt number must not be reused.
+			if j, task := c.journaledTask(entry); task != nil {
+				task.SetAttempt(max(task.GetAttempt(), entry.Attempt))
+
+				if j.state == JobQueued {
+					j.state = JobRunning
+				}
+			}
+
+		case OpCompleted:
+			j, task := c.journaledTask(entry)
+			if task == nil || task.IsCompleted() {
+				continue
+			}
+
+			if !filesExist(entry.IntermediateFilenames) || !filesExist(outputFilenames(task)) {
+				log.Printf("output of %+v is gone, it will run again", task)
+				continue
+			}
+
+			task.SetAttempt(max(task.GetAttempt(), entry.Attempt))
+			task.Complete(entry.Attempt)
+			j.addCounters(task, entry.Counters)
+
+			if task.Is(Map) {
+				j.recordIntermediates(task.GetStage(), task.GetId(), entry.IntermediateFilenames)
+			}
+
+		case OpFailed:
+			j, task := c.journaledTask(entry)
+			if task == nil {
+				continue
+			}
+
+			if entry.BadRecord != nil && j.spec.SkipBadRecords {
+				skipRecord(task, *entry.BadRecord)
+			}
+
+			for i := 0; i < max(1, entry.Failures); i++ {
+				c.failAttempt(j, task, entry.Attempt, entry.Reason)
+			}
+
+		case OpCounters:
+			if j := c.job(entry.Job); j != nil {
+				j.addCounters(nil, entry.Counters)
+			}
+
+		default:
+			log.Printf("unknown journal entry: %+v", entry)
+		}
+	}
+
+	for _, j := range c.jobs {
+		if !j.isFinished() && j.allTasksCompleted() {
+			c.finish(j, JobSucceeded)
+		}
+	}
+
+	return true
+}
+
+// the task a journal entry is about, and its job.
+func (c *Coordinator) journaledTask(entry JournalEntry) (*job, ITask) {
+	j := c.job(entry.Job)
+	if j == nil {
+		return nil, nil
+	}
+
+	task := j.getTask(entry.Stage, entry.Type, entry.Id)
+	if task == nil {
+		return nil, nil
+	}
+
+	return j, task
+}
+
+// the final output files of a task, if it writes any
+// besides intermediate files.
+func outputFilenames(task ITask) []string {
+	switch task := task.(type) {
+	case *MapTask:
+		return []string{task.OutputFilename}
+	case *ReduceTask:
+		return []string{task.OutputFilename}
+	}
+
+	return nil
+}
+
+func filesExist(filenames []string) bool {
+	for _, filename := range filenames {
+		if filename == "" {
+			continue
+		}
+
+		if _, err := os.Stat(filename); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,384 @@
+package mr
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// the expiry of leases that tests never let run out.
+var farFuture = time.Now().Add(time.Hour)
+
+func testCoordinator(t *testing.T, spec JobSpec) *Coordinator {
+	c := newCoordinator()
+
+	j, err := newJob(0, spec, nil)
+	if err != nil {
+		t.Fatalf("cannot create job: %v", err)
+	}
+
+	c.jobs = append(c.jobs, j)
+	c.nextJobId = 1
+
+	// for the handlers, which record what they do.
+	journal, _, err := openJournal(filepath.Join(t.TempDir(), JournalFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.journal = journal
+	t.Cleanup(func() { journal.file.Close() })
+
+	return c
+}
+
+func submitTestJob(t *testing.T, c *Coordinator, spec JobSpec) *job {
+	j, err := newJob(c.nextJobId, spec, nil)
+	if err != nil {
+		t.Fatalf("cannot create job: %v", err)
+	}
+
+	c.nextJobId++
+	c.jobs = append(c.jobs, j)
+
+	return j
+}
+
+// commit the next attempt of a map task, with an intermediate
+// file in dir for every partition.
+func completeMapTask(t *testing.T, j *job, id int, dir string) {
+	task := j.getTask("", Map, id).(*MapTask)
+	task.Schedule(1, farFuture)
+
+	filenames := make([]string, task.NReduce)
+	for r := range filenames {
+		filenames[r] = filepath.Join(dir, intermediateFilename(j.id, "", id, r))
+		if err := os.WriteFile(filenames[r], nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	task.Complete(task.Attempt)
+	j.recordIntermediates("", id, filenames)
+	j.addCounters(task, map[string]int64{"records": 10})
+}
+
+// what replay must bring back, leaving out times and leases.
+type replayedJob struct {
+	State    JobState
+	Counters map[string]int64
+	Error    string
+	Skipped  []string
+	Tasks    []replayedTask
+}
+
+type replayedTask struct {
+	Type           TaskType
+	Id             int
+	Completed      bool
+	Skipped        bool
+	Attempt        int
+	Committed      int
+	Failures       int
+	Error          string
+	InputFilenames []string
+	SkipRecords    []int
+	SkipKeys       []string
+}
+
+func replayedState(c *Coordinator) []replayedJob {
+	var jobs []replayedJob
+
+	for _, j := range c.jobs {
+		status := j.status()
+		rj := replayedJob{State: j.state, Counters: status.Counters, Error: status.Error, Skipped: status.Skipped}
+
+		for _, task := range j.tasks {
+			rt := replayedTask{
+				Type:      task.GetType(),
+				Id:        task.GetId(),
+				Completed: task.IsCompleted(),
+				Skipped:   task.IsSkipped(),
+				Attempt:   task.GetAttempt(),
+				Committed: task.GetCommittedAttempt(),
+				Failures:  task.GetFailures(),
+				Error:     task.GetError(),
+			}
+
+			switch task := task.(type) {
+			case *MapTask:
+				rt.SkipRecords = task.SkipRecords
+			case *ReduceTask:
+				rt.InputFilenames = task.InputFilenames
+				rt.SkipKeys = task.SkipKeys
+			}
+
+			rj.Tasks = append(rj.Tasks, rt)
+		}
+
+		jobs = append(jobs, rj)
+	}
+
+	return jobs
+}
+
+func TestSnapshotReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	spec := JobSpec{
+		Files:          []string{"in-0", "in-1", "in-2", "in-3"},
+		Stages:         []Stage{{NReduce: 2}},
+		MaxAttempts:    2,
+		OnFailure:      SkipBadInputs,
+		SkipBadRecords: true,
+	}
+
+	c := testCoordinator(t, spec)
+	j0 := c.jobs[0]
+	j0.state = JobRunning
+
+	// two map tasks and a reduce task committed, a map task skipped
+	// after a bad record and a plain failure, and a map task with a
+	// failure that is still running.
+	completeMapTask(t, j0, 0, dir)
+	completeMapTask(t, j0, 1, dir)
+
+	chdirTemp(t)
+	if err := os.WriteFile("mr-out-1", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reduce := j0.getTask("", Reduce, 1)
+	reduce.Schedule(1, farFuture)
+	reduce.Complete(1)
+	j0.addCounters(reduce, map[string]int64{"records": 3, "keys": 2})
+
+	bad := j0.getTask("", Map, 2)
+	bad.Schedule(1, farFuture)
+	skipRecord(bad, BadRecord{Index: 7})
+	c.failAttempt(j0, bad, 1, "panic: bad record")
+	bad.Schedule(1, farFuture)
+	c.failAttempt(j0, bad, 2, "panic: worse record")
+
+	flaky := j0.getTask("", Map, 3)
+	flaky.Schedule(1, farFuture)
+	c.failAttempt(j0, flaky, 1, "lease of worker 1 expired")
+	flaky.Schedule(2, farFuture)
+
+	// a job that failed on a reduce task.
+	j1 := submitTestJob(t, c, JobSpec{Files: []string{"in-0"}, Stages: []Stage{{NReduce: 1}}, MaxAttempts: 2})
+	completeMapTask(t, j1, 0, dir)
+	failing := j1.getTask("", Reduce, 0)
+	for attempt := 1; attempt <= 2; attempt++ {
+		failing.Schedule(1, farFuture)
+		c.failAttempt(j1, failing, attempt, "cannot read input")
+	}
+
+	// and a cancelled one.
+	j2 := submitTestJob(t, c, JobSpec{Files: []string{"in-0"}, Stages: []Stage{{NReduce: 1}}})
+	c.finish(j2, JobCancelled)
+
+	c.nextWorkerId = 2
+
+	if !bad.IsSkipped() {
+		t.Fatalf("map task 2 was not skipped")
+	}
+
+	if j1.state != JobFailed {
+		t.Fatalf("job 1 is %s, not failed", j1.state)
+	}
+
+	replayed := testCoordinator(t, spec)
+
+	if !replayed.replay(c.snapshot()) {
+		t.Fatalf("replay rejected the snapshot of the same job")
+	}
+
+	want, got := replayedState(c), replayedState(replayed)
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("replayed state differs:\n got %+v\nwant %+v", got, want)
+	}
+
+	if replayed.nextWorkerId != 2 || replayed.nextJobId != 3 {
+		t.Fatalf("replayed nextWorkerId %d, nextJobId %d, want 2 and 3", replayed.nextWorkerId, replayed.nextJobId)
+	}
+
+	// a second round trip changes nothing.
+	again := testCoordinator(t, spec)
+	again.replay(replayed.snapshot())
+
+	if got := replayedState(again); !reflect.DeepEqual(got, want) {
+		t.Fatalf("second replay differs:\n got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestReplayLostIntermediates(t *testing.T) {
+	dir := t.TempDir()
+	spec := JobSpec{Files: []string{"in-0", "in-1"}, Stages: []Stage{{NReduce: 2}}}
+
+	c := testCoordinator(t, spec)
+	completeMapTask(t, c.jobs[0], 0, dir)
+	completeMapTask(t, c.jobs[0], 1, dir)
+
+	// the files of map task 1 are gone, so it must run again,
+	// and the reduce tasks must not read them.
+	for _, filename := range c.jobs[0].intermediates[1] {
+		os.Remove(filename)
+	}
+
+	replayed := testCoordinator(t, spec)
+	replayed.replay(c.snapshot())
+	j := replayed.jobs[0]
+
+	if !j.getTask("", Map, 0).IsCompleted() || j.getTask("", Map, 1).IsCompleted() {
+		t.Fatalf("want map task 0 completed and map task 1 to run again")
+	}
+
+	if attempt := j.getTask("", Map, 1).GetAttempt(); attempt != 1 {
+		t.Fatalf("map task 1 has attempt %d, want 1 so that it is not reused", attempt)
+	}
+
+	for r := 0; r < 2; r++ {
+		want := []string{c.jobs[0].intermediates[0][r]}
+		if got := j.getTask("", Reduce, r).(*ReduceTask).InputFilenames; !reflect.DeepEqual(got, want) {
+			t.Fatalf("reduce task %d reads %v, want %v", r, got, want)
+		}
+	}
+
+	if n := j.counters["records"]; n != 10 {
+		t.Fatalf("records counter is %d, want 10", n)
+	}
+}
+
+func TestReplayOtherJob(t *testing.T) {
+	c := testCoordinator(t, JobSpec{Files: []string{"in-0"}, Stages: []Stage{{NReduce: 1}}})
+	other := testCoordinator(t, JobSpec{Files: []string{"in-1"}, Stages: []Stage{{NReduce: 1}}})
+
+	if other.replay(c.snapshot()) {
+		t.Fatalf("replay accepted the journal of another job")
+	}
+}
+
+func TestJournalTornEntry(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), JournalFilename)
+
+	j, entries, err := openJournal(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 0 {
+		t.Fatalf("new journal has %d entries", len(entries))
+	}
+
+	want := []JournalEntry{
+		{Op: OpRegistered, WorkerId: 3},
+		{Op: OpScheduled, Job: 1, Type: Map, Id: 2, Attempt: 1},
+	}
+
+	if err := j.rewrite(want[:1]); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := j.append(want[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash in the middle of the next append.
+	if _, err := j.file.WriteString(`{"Op":"completed","Jo`); err != nil {
+		t.Fatal(err)
+	}
+
+	j.file.Close()
+
+	j, got, err := openJournal(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.file.Close()
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got entries %+v, want %+v", got, want)
+	}
+}
+
+func TestReplayLostOutput(t *testing.T) {
+	chdirTemp(t)
+	spec := JobSpec{Files: []string{"in-0"}, Stages: []Stage{{NReduce: 1}}}
+
+	c := testCoordinator(t, spec)
+	j := c.jobs[0]
+	completeMapTask(t, j, 0, ".")
+
+	reduce := j.getTask("", Reduce, 0)
+	reduce.Schedule(1, farFuture)
+	reduce.Complete(1)
+	c.finish(j, JobSucceeded)
+
+	// mr-out-0 was never written, or has been removed since.
+	replayed := testCoordinator(t, spec)
+	replayed.replay(c.snapshot())
+
+	if state := replayed.jobs[0].state; state == JobSucceeded {
+		t.Fatalf("job with lost output resumed as %s", state)
+	}
+
+	if replayed.jobs[0].getTask("", Reduce, 0).IsCompleted() {
+		t.Fatalf("reduce task with lost output resumed as completed")
+	}
+
+	if err := os.WriteFile("mr-out-0", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	replayed = testCoordinator(t, spec)
+	replayed.replay(c.snapshot())
+
+	if state := replayed.jobs[0].state; state != JobSucceeded {
+		t.Fatalf("job with its output resumed as %s", state)
+	}
+}
+
+func TestDoneRetiresJournal(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), JournalFilename)
+
+	c := testCoordinator(t, JobSpec{Files: []string{"in-0"}, Stages: []Stage{{NReduce: 1}}})
+	c.exitWhenDone = true
+
+	j, _, err := openJournal(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.journal = j
+	c.compact()
+
+	if c.Done() {
+		t.Fatalf("done before the job is")
+	}
+
+	c.finish(c.jobs[0], JobSucceeded)
+
+	if !c.Done() {
+		t.Fatalf("not done after the job and without workers")
+	}
+
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Fatalf("journal of a finished job still there: %v", err)
+	}
+
+	// late entries must not bring it back.
+	for i := 0; i < JournalCompactThreshold+1; i++ {
+		c.record(JournalEntry{Op: OpRegistered, WorkerId: i})
+	}
+
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Fatalf("journal came back: %v", err)
+	}
+
+	if !c.Done() {
+		t.Fatalf("not done on the second call")
+	}
+}
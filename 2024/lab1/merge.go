@@ -0,0 +1,383 @@
+package mr
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// reduce tasks read their input as one sorted stream, merged from the
+// (already sorted) intermediate files, so that a partition never has to
+// fit in memory. the merge checks the order of keys as it goes; inputs
+// that turn out not to be sorted are cut into sorted runs on disk, and
+// the task starts over.
+
+// by default a reduce task keeps this much KeyValue data in memory.
+const DefaultMemoryBudget = 64 << 20
+
+// rough memory cost of an open stream; limits how many
+// streams are merged at once.
+const streamBufferSize = 64 << 10
+
+// spill files never leave the reduce task that wrote them,
+// so they always use the cheapest codec.
+const spillCodec = "binary"
+
+type kvStream interface {
+	// returns io.EOF after the last KeyValue.
+	Next() (KeyValue, error)
+	Close() error
+}
+
+type fileStream struct {
+	filename string
+	file     *os.File
+	dec      KVDecoder
+	// fail with an unsortedError if a key comes after a greater one.
+	check    bool
+	previous string
+}
+
+// a merged file that turned out not to be sorted by key.
+type unsortedError struct {
+	filename string
+}
+
+func (e *unsortedError) Error() string {
+	return fmt.Sprintf("%v is not sorted by key", e.filename)
+}
+
+func openStream(filename string) (*fileStream, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	dec, err := newKVDecoder(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%v: %v", filename, err)
+	}
+
+	return &fileStream{filename: filename, file: file, dec: dec}, nil
+}
+
+func (s *fileStream) Next() (KeyValue, error) {
+	var kv KeyValue
+	if err := s.dec.Decode(&kv); err != nil {
+		return kv, err
+	}
+
+	if s.check {
+		if kv.Key < s.previous {
+			return KeyValue{}, &unsortedError{filename: s.filename}
+		}
+		s.previous = kv.Key
+	}
+
+	return kv, nil
+}
+
+func (s *fileStream) Close() error {
+	return s.file.Close()
+}
+
+type mergeItem struct {
+	kv     KeyValue
+	stream kvStream
+	// position of the stream, so that equal keys keep their input order.
+	index int
+}
+
+type mergeHeap []*mergeItem
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].kv.Key != h[j].kv.Key {
+		return h[i].kv.Key < h[j].kv.Key
+	}
+	return h[i].index < h[j].index
+}
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(*mergeItem)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// k-way merge of sorted streams.
+type mergeStream struct {
+	heap mergeHeap
+}
+
+func newMergeStream(streams []kvStream) (*mergeStream, error) {
+	m := &mergeStream{}
+
+	for i, stream := range streams {
+		kv, err := stream.Next()
+
+		if err == io.EOF {
+			stream.Close()
+			continue
+		}
+
+		if err != nil {
+			for _, s := range streams[i:] {
+				s.Close()
+			}
+			m.Close()
+			return nil, err
+		}
+
+		m.heap = append(m.heap, &mergeItem{kv: kv, stream: stream, index: i})
+	}
+
+	heap.Init(&m.heap)
+
+	return m, nil
+}
+
+func (m *mergeStream) Next() (KeyValue, error) {
+	if len(m.heap) == 0 {
+		return KeyValue{}, io.EOF
+	}
+
+	top := m.heap[0]
+	kv := top.kv
+
+	next, err := top.stream.Next()
+
+	if err == io.EOF {
+		heap.Pop(&m.heap)
+		top.stream.Close()
+	} else if err != nil {
+		return KeyValue{}, err
+	} else {
+		top.kv = next
+		heap.Fix(&m.heap, 0)
+	}
+
+	return kv, nil
+}
+
+func (m *mergeStream) Close() error {
+	for _, item := range m.heap {
+		item.stream.Close()
+	}
+
+	m.heap = nil
+
+	return nil
+}
+
+// sort kva and write it to a new spill file.
+func writeRun(kva []KeyValue) (string, error) {
+	sort.Stable(ByKey(kva))
+	return writeStream(&sliceStream{kva: kva})
+}
+
+type sliceStream struct {
+	kva []KeyValue
+}
+
+func (s *sliceStream) Next() (KeyValue, error) {
+	if len(s.kva) == 0 {
+		return KeyValue{}, io.EOF
+	}
+
+	kv := s.kva[0]
+	s.kva = s.kva[1:]
+
+	return kv, nil
+}
+
+func (s *sliceStream) Close() error {
+	return nil
+}
+
+// cut an unsorted file into sorted runs of at most budget bytes each.
+func spillRuns(filename string, budget int64) ([]string, error) {
+	stream, err := openStream(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	var runs []string
+	var buffer []KeyValue
+	var size int64
+
+	for {
+		kv, err := stream.Next()
+
+		if err != nil && err != io.EOF {
+			return runs, err
+		}
+
+		if err == nil {
+			buffer = append(buffer, kv)
+			size += int64(len(kv.Key) + len(kv.Value) + 32)
+		}
+
+		if len(buffer) > 0 && (size >= budget || err == io.EOF) {
+			run, werr := writeRun(buffer)
+			if werr != nil {
+				return runs, werr
+			}
+
+			runs = append(runs, run)
+			buffer, size = nil, 0
+		}
+
+		if err == io.EOF {
+			return runs, nil
+		}
+	}
+}
+
+// open files to merge, checking that they are sorted as they are read.
+func openStreams(filenames []string) ([]kvStream, error) {
+	var streams []kvStream
+
+	for _, filename := range filenames {
+		stream, err := openStream(filename)
+		if err != nil {
+			for _, s := range streams {
+				s.Close()
+			}
+			return nil, err
+		}
+
+		stream.check = true
+		streams = append(streams, stream)
+	}
+
+	return streams, nil
+}
+
+// merge sorted files into a single sorted stream, opening no more than
+// budget allows at once. files merged along the way are added to
+// *spills, which the caller removes once it is done with the stream.
+func mergeFiles(filenames []string, budget int64, spills *[]string) (kvStream, error) {
+	fanIn := int(max(2, budget/streamBufferSize))
+
+	// every pass merges neighbouring files, and puts the result where
+	// they were, so that equal keys keep their input order.
+	for len(filenames) > fanIn {
+		var merged []string
+
+		for len(filenames) > 0 {
+			group := filenames[:min(fanIn, len(filenames))]
+			filenames = filenames[len(group):]
+
+			if len(group) == 1 {
+				merged = append(merged, group[0])
+				continue
+			}
+
+			streams, err := openStreams(group)
+			if err != nil {
+				return nil, err
+			}
+
+			stream, err := newMergeStream(streams)
+			if err != nil {
+				return nil, err
+			}
+
+			run, err := writeStream(stream)
+			if err != nil {
+				return nil, err
+			}
+
+			*spills = append(*spills, run)
+			merged = append(merged, run)
+		}
+
+		filenames = merged
+	}
+
+	streams, err := openStreams(filenames)
+	if err != nil {
+		return nil, err
+	}
+
+	return newMergeStream(streams)
+}
+
+// drain a stream into a new spill file and return its name.
+func writeStream(stream kvStream) (string, error) {
+	defer stream.Close()
+
+	file, err := os.CreateTemp(".", "mr-tmp-spill-*")
+	if err != nil {
+		return "", err
+	}
+
+	enc, err := newKVEncoder(file, spillCodec)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	for {
+		kv, err := stream.Next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err == nil {
+			err = enc.Encode(&kv)
+		}
+
+		if err != nil {
+			file.Close()
+			os.Remove(file.Name())
+			return "", err
+		}
+	}
+
+	if err := enc.Close(); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	return file.Name(), nil
+}
+
+// the sorted input stream of a reduce task, which fails with an
+// unsortedError if a file outside unsorted is not sorted after all.
+// *spills collects the temporary files the stream depends on.
+func openReduceInput(filenames []string, unsorted map[string]bool, budget int64, spills *[]string) (kvStream, error) {
+	var sorted []string
+
+	for _, filename := range filenames {
+		if !unsorted[filename] {
+			sorted = append(sorted, filename)
+			continue
+		}
+
+		runs, err := spillRuns(filename, budget)
+		*spills = append(*spills, runs...)
+
+		if err != nil {
+			return nil, err
+		}
+
+		sorted = append(sorted, runs...)
+	}
+
+	return mergeFiles(sorted, budget, spills)
+}
@@ -0,0 +1,222 @@
+package mr
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// run the test in a fresh directory, where spill files go.
+func chdirTemp(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.Chdir(dir) })
+}
+
+// n KeyValues with few distinct keys, numbered in their
+// values so that the order of equal keys shows.
+func randomKVs(rng *rand.Rand, n int, first int) []KeyValue {
+	kva := make([]KeyValue, n)
+
+	for i := range kva {
+		kva[i] = KeyValue{Key: fmt.Sprintf("k%02d", rng.Intn(20)), Value: fmt.Sprint(first + i)}
+	}
+
+	return kva
+}
+
+func writeKVs(t *testing.T, filename string, codec string, kva []KeyValue) {
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	enc, err := newKVEncoder(file, codec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range kva {
+		if err := enc.Encode(&kva[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readStream(t *testing.T, stream kvStream) []KeyValue {
+	defer stream.Close()
+
+	var kva []KeyValue
+
+	for {
+		kv, err := stream.Next()
+		if err == io.EOF {
+			return kva
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		kva = append(kva, kv)
+	}
+}
+
+func readKVs(t *testing.T, filename string) []KeyValue {
+	stream, err := openStream(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return readStream(t, stream)
+}
+
+func stableSorted(kva []KeyValue) []KeyValue {
+	sorted := append([]KeyValue(nil), kva...)
+	sort.Stable(ByKey(sorted))
+	return sorted
+}
+
+func TestSpillRuns(t *testing.T) {
+	chdirTemp(t)
+
+	kva := randomKVs(rand.New(rand.NewSource(1)), 500, 0)
+	writeKVs(t, "input", DefaultCodec, kva)
+
+	runs, err := spillRuns("input", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(runs) < 10 {
+		t.Fatalf("got %d runs, want a tiny budget to make many", len(runs))
+	}
+
+	var all []KeyValue
+
+	for _, run := range runs {
+		kva := readKVs(t, run)
+		if !reflect.DeepEqual(kva, stableSorted(kva)) {
+			t.Fatalf("run %v is not sorted", run)
+		}
+
+		all = append(all, kva...)
+	}
+
+	if len(all) != len(kva) {
+		t.Fatalf("runs hold %d records, want %d", len(all), len(kva))
+	}
+}
+
+func TestMergeFilesMultiPass(t *testing.T) {
+	chdirTemp(t)
+
+	rng := rand.New(rand.NewSource(2))
+
+	var filenames []string
+	var all []KeyValue
+
+	// more files than one pass can merge.
+	for i := 0; i < 7; i++ {
+		kva := stableSorted(randomKVs(rng, 50, len(all)))
+		filename := fmt.Sprintf("input-%d", i)
+		writeKVs(t, filename, "binary", kva)
+
+		filenames = append(filenames, filename)
+		all = append(all, kva...)
+	}
+
+	var spills []string
+
+	stream, err := mergeFiles(filenames, 2*streamBufferSize, &spills)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := readStream(t, stream), stableSorted(all); !reflect.DeepEqual(got, want) {
+		t.Fatalf("merge differs from a stable sort:\n got %v\nwant %v", got, want)
+	}
+
+	if len(spills) == 0 {
+		t.Fatalf("merging %d files two at a time wrote no intermediate runs", len(filenames))
+	}
+}
+
+func TestOpenReduceInput(t *testing.T) {
+	chdirTemp(t)
+
+	rng := rand.New(rand.NewSource(3))
+
+	var filenames []string
+	var all []KeyValue
+
+	// sorted and unsorted inputs, in several codecs.
+	for i, codec := range []string{"json", "binary", "binary-flate", "binary-gzip", "json"} {
+		kva := randomKVs(rng, 200, len(all))
+		if i%2 == 0 {
+			kva = stableSorted(kva)
+		}
+
+		filename := fmt.Sprintf("input-%d", i)
+		writeKVs(t, filename, codec, kva)
+
+		filenames = append(filenames, filename)
+		all = append(all, kva...)
+	}
+
+	// the merge finds the unsorted inputs one at a time, and
+	// nothing else.
+	unsorted := make(map[string]bool)
+	var spills []string
+
+	for {
+		stream, err := openReduceInput(filenames, unsorted, 1000, &spills)
+
+		var kva []KeyValue
+		for err == nil {
+			var kv KeyValue
+			if kv, err = stream.Next(); err == nil {
+				kva = append(kva, kv)
+			}
+		}
+
+		var unsortedErr *unsortedError
+		if errors.As(err, &unsortedErr) {
+			if stream != nil {
+				stream.Close()
+			}
+			unsorted[unsortedErr.filename] = true
+			continue
+		}
+
+		if err != io.EOF {
+			t.Fatal(err)
+		}
+
+		if want := stableSorted(all); !reflect.DeepEqual(kva, want) {
+			t.Fatalf("reduce input differs from a stable sort:\n got %v\nwant %v", kva, want)
+		}
+
+		break
+	}
+
+	if want := map[string]bool{"input-1": true, "input-3": true}; !reflect.DeepEqual(unsorted, want) {
+		t.Fatalf("found %v unsorted, want %v", unsorted, want)
+	}
+}
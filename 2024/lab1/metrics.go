@@ -0,0 +1,294 @@
+package mr
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the coordinator serves /metrics in the Prometheus text format, for
+// itself and for the workers, which send their totals with every
+// heartbeat.
+
+// upper bounds, in seconds, of the buckets of duration histograms.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+type histogram struct {
+	// counts[i] is the number of observations of at most durationBuckets[i].
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(durationBuckets))
+	}
+
+	for i, bound := range durationBuckets {
+		if d.Seconds() <= bound {
+			h.counts[i]++
+		}
+	}
+
+	h.count++
+	h.sum += d.Seconds()
+}
+
+// what a worker did since it started. attempts count whether
+// or not the coordinator accepted them.
+type WorkerMetrics struct {
+	MapTasks     int64
+	ReduceTasks  int64
+	BytesRead    int64
+	BytesWritten int64
+}
+
+// the worker side of WorkerMetrics, updated by the task loop
+// and read by the heartbeat goroutine.
+type workerMetrics struct {
+	mapTasks     atomic.Int64
+	reduceTasks  atomic.Int64
+	bytesRead    atomic.Int64
+	bytesWritten atomic.Int64
+}
+
+func (m *workerMetrics) snapshot() WorkerMetrics {
+	return WorkerMetrics{
+		MapTasks:     m.mapTasks.Load(),
+		ReduceTasks:  m.reduceTasks.Load(),
+		BytesRead:    m.bytesRead.Load(),
+		BytesWritten: m.bytesWritten.Load(),
+	}
+}
+
+// add a finished attempt at task, which wrote outputs, to the metrics.
+func (m *workerMetrics) countTask(task ITask, outputs []OutputFile) {
+	switch task := task.(type) {
+	case *MapTask:
+		m.mapTasks.Add(1)
+
+		if task.Length > 0 {
+			m.bytesRead.Add(task.Length)
+		} else {
+			m.bytesRead.Add(fileSize(task.Filename))
+		}
+	case *ReduceTask:
+		m.reduceTasks.Add(1)
+
+		for _, filename := range task.InputFilenames {
+			m.bytesRead.Add(fileSize(filename))
+		}
+	}
+
+	for _, output := range outputs {
+		m.bytesWritten.Add(fileSize(output.TempName))
+	}
+}
+
+// zero if the file cannot be found.
+func fileSize(filename string) int64 {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return 0
+	}
+
+	return info.Size()
+}
+
+type coordinatorMetrics struct {
+	mutex       sync.Mutex
+	reschedules map[TaskType]int64
+	failures    map[TaskType]int64
+	// runtimes of committed attempts.
+	taskDurations map[TaskType]*histogram
+	// by RPC method.
+	rpcDurations map[string]*histogram
+	// the latest totals every worker sent. workers are kept after
+	// they go away, so that their totals never go down.
+	workers map[int]WorkerMetrics
+}
+
+func newCoordinatorMetrics() *coordinatorMetrics {
+	return &coordinatorMetrics{
+		reschedules:   make(map[TaskType]int64),
+		failures:      make(map[TaskType]int64),
+		taskDurations: make(map[TaskType]*histogram),
+		rpcDurations:  make(map[string]*histogram),
+		workers:       make(map[int]WorkerMetrics),
+	}
+}
+
+// a task was scheduled again, after an attempt failed or as a backup.
+func (m *coordinatorMetrics) reschedule(taskType TaskType) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.reschedules[taskType]++
+}
+
+// an attempt failed.
+func (m *coordinatorMetrics) fail(taskType TaskType) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.failures[taskType]++
+}
+
+func (m *coordinatorMetrics) observeTask(taskType TaskType, runtime time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.taskDurations[taskType] == nil {
+		m.taskDurations[taskType] = &histogram{}
+	}
+
+	m.taskDurations[taskType].observe(runtime)
+}
+
+// meant to be deferred at the start of an RPC handler.
+func (m *coordinatorMetrics) observeRPC(method string, start time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.rpcDurations[method] == nil {
+		m.rpcDurations[method] = &histogram{}
+	}
+
+	m.rpcDurations[method].observe(time.Since(start))
+}
+
+func (m *coordinatorMetrics) updateWorker(workerId int, metrics WorkerMetrics) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.workers[workerId] = metrics
+}
+
+func (c *Coordinator) handleMetrics() {
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		c.writeMetrics(w)
+	})
+}
+
+func (c *Coordinator) writeMetrics(w io.Writer) {
+	_, tasks, workers := c.status(-1)
+
+	tasksByState := make(map[string]int64)
+
+	for _, task := range tasks {
+		labels := fmt.Sprintf(`job="%d",stage=%s,type=%s,state=%s`, task.Job, labelValue(task.Stage), labelValue(string(task.Type)), labelValue(string(task.State)))
+		tasksByState[labels]++
+	}
+
+	writeMetric(w, "mr_tasks", "gauge", "Tasks by job, stage, type and state.", tasksByState)
+	writeMetric(w, "mr_workers", "gauge", "Registered workers.", map[string]int64{"": int64(len(workers))})
+
+	c.metrics.mutex.Lock()
+	defer c.metrics.mutex.Unlock()
+
+	reschedules := make(map[string]int64)
+	for taskType, n := range c.metrics.reschedules {
+		reschedules["type="+labelValue(string(taskType))] = n
+	}
+
+	writeMetric(w, "mr_task_reschedules_total", "counter", "Attempts started after the first attempt of a task.", reschedules)
+
+	failures := make(map[string]int64)
+	for taskType, n := range c.metrics.failures {
+		failures["type="+labelValue(string(taskType))] = n
+	}
+
+	writeMetric(w, "mr_task_failures_total", "counter", "Attempts that failed or lost their lease.", failures)
+
+	taskDurations := make(map[string]*histogram)
+	for taskType, h := range c.metrics.taskDurations {
+		taskDurations["type="+labelValue(string(taskType))] = h
+	}
+
+	writeHistograms(w, "mr_task_duration_seconds", "Runtime of committed attempts.", taskDurations)
+
+	rpcs := make(map[string]int64)
+	rpcDurations := make(map[string]*histogram)
+
+	for method, h := range c.metrics.rpcDurations {
+		labels := "method=" + labelValue(method)
+		rpcs[labels] = int64(h.count)
+		rpcDurations[labels] = h
+	}
+
+	writeMetric(w, "mr_rpc_requests_total", "counter", "RPCs served by the coordinator.", rpcs)
+	writeHistograms(w, "mr_rpc_duration_seconds", "Time taken to serve RPCs, including long polls.", rpcDurations)
+
+	workerTasks := make(map[string]int64)
+	bytesRead := make(map[string]int64)
+	bytesWritten := make(map[string]int64)
+
+	for workerId, metrics := range c.metrics.workers {
+		labels := fmt.Sprintf(`worker="%d"`, workerId)
+		workerTasks[labels+`,type="map"`] = metrics.MapTasks
+		workerTasks[labels+`,type="reduce"`] = metrics.ReduceTasks
+		bytesRead[labels] = metrics.BytesRead
+		bytesWritten[labels] = metrics.BytesWritten
+	}
+
+	writeMetric(w, "mr_worker_tasks_total", "counter", "Attempts finished by workers.", workerTasks)
+	writeMetric(w, "mr_worker_read_bytes_total", "counter", "Bytes of input read by workers.", bytesRead)
+	writeMetric(w, "mr_worker_written_bytes_total", "counter", "Bytes of output written by workers.", bytesWritten)
+}
+
+// values are keyed by their labels, without the braces.
+func writeMetric(w io.Writer, name string, kind string, help string, values map[string]int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+
+	for _, labels := range sortedKeys(values) {
+		if labels == "" {
+			fmt.Fprintf(w, "%s %d\n", name, values[labels])
+		} else {
+			fmt.Fprintf(w, "%s{%s} %d\n", name, labels, values[labels])
+		}
+	}
+}
+
+func writeHistograms(w io.Writer, name string, help string, histograms map[string]*histogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+
+	for _, labels := range sortedKeys(histograms) {
+		h := histograms[labels]
+
+		for i, bound := range durationBuckets {
+			fmt.Fprintf(w, "%s_bucket{%s,le=%s} %d\n", name, labels, labelValue(strconv.FormatFloat(bound, 'g', -1, 64)), h.counts[i])
+		}
+
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+		fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, h.sum)
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+	}
+}
+
+// the text format escapes only backslashes, double quotes and
+// newlines in label values, unlike Go's %q.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// a quoted label value.
+func labelValue(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
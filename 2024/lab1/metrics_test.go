@@ -0,0 +1,20 @@
+package mr
+
+import "testing"
+
+func TestLabelValue(t *testing.T) {
+	values := map[string]string{
+		"":             `""`,
+		"map":          `"map"`,
+		`a\b`:          `"a\\b"`,
+		`say "hi"`:     `"say \"hi\""`,
+		"two\nlines":   `"two\nlines"`,
+		"tab\tand ünï": "\"tab\tand ünï\"",
+	}
+
+	for value, want := range values {
+		if got := labelValue(value); got != want {
+			t.Errorf("labelValue(%q) = %s, want %s", value, got, want)
+		}
+	}
+}
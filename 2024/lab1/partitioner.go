@@ -0,0 +1,145 @@
+package mr
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// chooses the reduce partition for each KeyValue emitted by Map.
+type Partitioner interface {
+	Partition(key string, nReduce int) int
+}
+
+// the coordinator hands every map task the configuration of the job's
+// partitioner, and the worker builds the partitioner from it.
+type PartitionerConfig struct {
+	// name the partitioner was registered under. empty means "hash".
+	Name string
+	// upper bounds of all partitions but the last, for "range".
+	SplitPoints []string
+}
+
+func (pc PartitionerConfig) equal(other PartitionerConfig) bool {
+	if pc.Name != other.Name || len(pc.SplitPoints) != len(other.SplitPoints) {
+		return false
+	}
+
+	for i := range pc.SplitPoints {
+		if pc.SplitPoints[i] != other.SplitPoints[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// spreads keys evenly, but unordered, over the partitions.
+type HashPartitioner struct{}
+
+func (HashPartitioner) Partition(key string, nReduce int) int {
+	return ihash(key) % nReduce
+}
+
+// keeps keys ordered across partitions: partition i gets the keys in
+// [SplitPoints[i-1], SplitPoints[i]), so concatenating the reduce
+// outputs gives globally sorted output.
+type RangePartitioner struct {
+	SplitPoints []string
+}
+
+func (p RangePartitioner) Partition(key string, nReduce int) int {
+	partition := sort.Search(len(p.SplitPoints), func(i int) bool {
+		return p.SplitPoints[i] > key
+	})
+
+	return min(partition, nReduce-1)
+}
+
+var (
+	partitionersMutex sync.Mutex
+	partitioners      = map[string]func(PartitionerConfig) Partitioner{
+		"hash": func(PartitionerConfig) Partitioner {
+			return HashPartitioner{}
+		},
+		"range": func(config PartitionerConfig) Partitioner {
+			return RangePartitioner{SplitPoints: config.SplitPoints}
+		},
+	}
+)
+
+// make a partitioner available to map tasks under name. applications
+// call this alongside handing mapf and reducef to Worker, and in the
+// coordinator, which checks the partitioner of every job, before
+// selecting it for a job with WithPartitioner.
+func RegisterPartitioner(name string, factory func(PartitionerConfig) Partitioner) {
+	partitionersMutex.Lock()
+	defer partitionersMutex.Unlock()
+
+	partitioners[name] = factory
+}
+
+func makePartitioner(config PartitionerConfig) (Partitioner, error) {
+	partitionersMutex.Lock()
+	defer partitionersMutex.Unlock()
+
+	name := config.Name
+	if name == "" {
+		name = "hash"
+	}
+
+	factory, ok := partitioners[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown partitioner %q", name)
+	}
+
+	return factory(config), nil
+}
+
+// pick nReduce-1 split points that cut a sample of the job's keys
+// into partitions of about the same size.
+func SampleSplitPoints(sample []string, nReduce int) []string {
+	keys := append([]string(nil), sample...)
+	sort.Strings(keys)
+
+	var splitPoints []string
+
+	for i := 1; i < nReduce && len(keys) > 0; i++ {
+		splitPoint := keys[i*len(keys)/nReduce]
+
+		// duplicate split points would leave partitions empty.
+		if len(splitPoints) == 0 || splitPoints[len(splitPoints)-1] < splitPoint {
+			splitPoints = append(splitPoints, splitPoint)
+		}
+	}
+
+	return splitPoints
+}
+
+// sample the keys of a job by running mapf over the first sampleBytes
+// of every input file.
+func SampleKeys(files []string, mapf func(string, string) []KeyValue, sampleBytes int64) ([]string, error) {
+	var keys []string
+
+	for _, filename := range files {
+		file, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		content, err := io.ReadAll(io.LimitReader(file, sampleBytes))
+		file.Close()
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, kv := range mapf(filename, string(content)) {
+			keys = append(keys, kv.Key)
+		}
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,150 @@
+package mr
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// a pipeline is a graph of MapReduce stages. a stage maps the reduce
+// output of the stages it depends on, or the files of the job if it
+// depends on none, and its tasks are handed out once those stages are
+// done. every stage keeps its files apart from the others': the
+// intermediate files of stage s are mr-s-X-Y and its output mr-s-out-Y,
+// except for the output of the last stage, which is mr-out-Y. (mr is
+// replaced by mr-jN for jobs other than the first, see job.go.) stages
+// with NReduce zero are map-only: they have no reduce tasks, and Y is
+// the id of the map task that wrote the output file. bad records that
+// task T of type t left out are in mr-skipped-t-T, or mr-s-skipped-t-T.
+
+type Stage struct {
+	// selects the map and reduce functions workers registered for the
+	// stage with WithStage. may only be empty in single-stage jobs.
+	Name string
+	// zero makes the stage map-only.
+	NReduce int
+	// stages whose output this stage maps. they must come before it.
+	Inputs []string
+	// empty means the format picked with WithInputFormat or
+	// WithOutputFormat, respectively.
+	InputFormat  string
+	OutputFormat string
+	// write out the sorted map output of every partition as is, instead
+	// of calling the stage's reduce function, which may then be nil.
+	IdentityReduce bool
+}
+
+func (s Stage) equal(other Stage) bool {
+	return s.Name == other.Name && s.NReduce == other.NReduce && slices.Equal(s.Inputs, other.Inputs) &&
+		s.InputFormat == other.InputFormat && s.OutputFormat == other.OutputFormat &&
+		s.IdentityReduce == other.IdentityReduce
+}
+
+// returns an error if the stages don't form a pipeline.
+func checkStages(stages []Stage) error {
+	if len(stages) == 0 {
+		return errors.New("a pipeline needs at least one stage")
+	}
+
+	seen := make(map[string]bool)
+
+	for _, stage := range stages {
+		if stage.NReduce < 0 {
+			return errors.New("nReduce must not be negative")
+		}
+
+		if stage.Name == "" && len(stages) > 1 {
+			return errors.New("stages of a pipeline must be named")
+		}
+
+		if seen[stage.Name] {
+			return fmt.Errorf("duplicate stage %q", stage.Name)
+		}
+
+		for _, input := range stage.Inputs {
+			if !seen[input] {
+				return fmt.Errorf("stage %q reads stage %q, which does not come before it", stage.Name, input)
+			}
+		}
+
+		seen[stage.Name] = true
+	}
+
+	return nil
+}
+
+func intermediateFilename(jobId int, stage string, mapId int, reduceId int) string {
+	if stage == "" {
+		return fmt.Sprintf("%s-%d-%d", jobPrefix(jobId), mapId, reduceId)
+	}
+
+	return fmt.Sprintf("%s-%s-%d-%d", jobPrefix(jobId), stage, mapId, reduceId)
+}
+
+// the records attempts of a task left out, see skip.go.
+func skippedFilename(jobId int, stage string, taskType TaskType, id int) string {
+	if stage == "" {
+		return fmt.Sprintf("%s-skipped-%s-%d", jobPrefix(jobId), taskType, id)
+	}
+
+	return fmt.Sprintf("%s-%s-skipped-%s-%d", jobPrefix(jobId), stage, taskType, id)
+}
+
+func (j *job) outputFilename(stage string, reduceId int) string {
+	if stage == j.spec.Stages[len(j.spec.Stages)-1].Name {
+		return fmt.Sprintf("%s-out-%d", jobPrefix(j.id), reduceId)
+	}
+
+	return fmt.Sprintf("%s-%s-out-%d", jobPrefix(j.id), stage, reduceId)
+}
+
+// which stages are done with their map tasks,
+// and which are done altogether.
+func (j *job) stageProgress() (map[string]bool, map[string]bool) {
+	mapped := make(map[string]bool)
+	done := make(map[string]bool)
+
+	for _, stage := range j.spec.Stages {
+		mapped[stage.Name] = true
+		done[stage.Name] = true
+	}
+
+	for _, task := range j.tasks {
+		if !task.IsCompleted() {
+			done[task.GetStage()] = false
+
+			if task.Is(Map) {
+				mapped[task.GetStage()] = false
+			}
+		}
+	}
+
+	return mapped, done
+}
+
+// whether the input of a stage's map tasks is complete.
+func (j *job) stageStarted(name string, done map[string]bool) bool {
+	for _, stage := range j.spec.Stages {
+		if stage.Name != name {
+			continue
+		}
+
+		for _, input := range stage.Inputs {
+			if !done[input] {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// whether task can run: map tasks wait for the stages they read,
+// reduce tasks for the map tasks of their stage.
+func (j *job) isReady(task ITask, mapped map[string]bool, done map[string]bool) bool {
+	if task.Is(Reduce) {
+		return mapped[task.GetStage()]
+	}
+
+	return j.stageStarted(task.GetStage(), done)
+}
@@ -1,26 +1,118 @@
 package mr
 
 import (
+	"fmt"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
+type RegisterWorkerArgs struct {
+}
+
+type RegisterWorkerReply struct {
+	WorkerId          int
+	HeartbeatInterval time.Duration
+}
+
+type DrainWorkerArgs struct {
+	WorkerId int
+}
+
+type DrainWorkerReply struct {
+}
+
+type HeartbeatArgs struct {
+	WorkerId int
+	Task     ITask
+	Metrics  WorkerMetrics
+}
+
+type HeartbeatReply struct {
+	// false if the worker no longer holds the lease on its task.
+	Ack bool
+	// another attempt of the task was committed, stop working on it.
+	Cancel bool
+}
+
 type GetTaskArgs struct {
+	WorkerId int
 }
 
 type GetTaskReply struct {
 	Task ITask
 }
 
+// a file written by a worker under a private name, and the name the
+// coordinator renames it to once it accepts the attempt.
+type OutputFile struct {
+	TempName  string
+	FinalName string
+}
+
 type CompleteTaskArgs struct {
-	Task                  ITask
+	WorkerId int
+	Task     ITask
+	// final names of the files written by a map task, indexed by
+	// reduce partition. empty for partitions it emitted nothing for.
 	IntermediateFilenames []string
+	Outputs               []OutputFile
+	// counters of this attempt, see counters.go.
+	Counters map[string]int64
 }
 
 type CompleteTaskReply struct {
+	// true if the attempt was accepted and its outputs committed.
 	Ack bool
 }
 
+type FailTaskArgs struct {
+	WorkerId int
+	Task     ITask
+	Reason   string
+	// the record the map or reduce function panicked on, if any.
+	BadRecord *BadRecord
+}
+
+type FailTaskReply struct {
+}
+
+type SubmitJobArgs struct {
+	Spec JobSpec
+}
+
+type SubmitJobReply struct {
+	JobId int
+}
+
+type JobStatusArgs struct {
+	JobId int
+}
+
+type JobStatusReply struct {
+	State                JobState
+	MapTasks             int
+	CompletedMapTasks    int
+	ReduceTasks          int
+	CompletedReduceTasks int
+	SubmittedAt          time.Time
+	// zero until the job succeeds, fails or is cancelled.
+	FinishedAt time.Time
+	Counters   map[string]int64
+	// why the job failed, if it did.
+	Error string
+	// the tasks a job that skips bad inputs gave up on, and why.
+	Skipped []string
+}
+
+type CancelJobArgs struct {
+	JobId int
+}
+
+type CancelJobReply struct {
+}
+
 // Cook up a unique-ish UNIX-domain socket name
 // in /var/tmp, for the coordinator.
 // Can't use the current directory since
@@ -30,3 +122,31 @@ func coordinatorSock() string {
 	s += strconv.Itoa(os.Getuid())
 	return s
 }
+
+// the coordinator listens on, and workers dial, an address of the form
+// unix:///path/to/socket or tcp://host:port. MR_COORDINATOR overrides
+// the default, so that unmodified main programs can run on several
+// machines, as long as they share a filesystem and run in the same
+// directory: the coordinator renames the files that workers write.
+func defaultCoordinatorAddress() string {
+	if address := os.Getenv("MR_COORDINATOR"); address != "" {
+		return address
+	}
+
+	return "unix://" + coordinatorSock()
+}
+
+// split an address into the network and address net.Dial expects.
+func parseAddress(address string) (string, string, error) {
+	network, addr, ok := strings.Cut(address, "://")
+
+	if !ok || addr == "" {
+		return "", "", fmt.Errorf("bad coordinator address %q", address)
+	}
+
+	if network != "unix" && network != "tcp" {
+		return "", "", fmt.Errorf("unsupported network in coordinator address %q", address)
+	}
+
+	return network, addr, nil
+}
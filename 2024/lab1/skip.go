@@ -0,0 +1,158 @@
+package mr
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"slices"
+)
+
+// in jobs that skip bad records, a worker whose map or reduce function
+// panics tells the coordinator which record it panicked on, and later
+// attempts of the task leave that record out. the records an attempt
+// leaves out go to a side file, committed along with its other output.
+// every bad record still costs a failed attempt.
+
+// counters of the records attempts left out.
+const (
+	SkippedMapRecords = "skipped map records"
+	SkippedReduceKeys = "skipped reduce keys"
+)
+
+// a record a map or reduce function panicked on.
+type BadRecord struct {
+	// map records are numbered in the order the input format emits
+	// them from the task's split, starting at zero.
+	Index int
+	// the key of the record. reduce records are told apart by key.
+	Key string
+}
+
+// an attempt failed on a record.
+type badRecordError struct {
+	record BadRecord
+	err    error
+}
+
+func (e *badRecordError) Error() string {
+	return fmt.Sprintf("%v, on the record with key %q", e.err, e.record.Key)
+}
+
+func (e *badRecordError) Unwrap() error {
+	return e.err
+}
+
+// a panic of a user function, and the record it was called with.
+type recordPanic struct {
+	record BadRecord
+	value  any
+	stack  []byte
+}
+
+// call f on record, marking any panic with the record. runTask
+// recovers it.
+func guard(record BadRecord, f func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			panic(&recordPanic{record: record, value: r, stack: debug.Stack()})
+		}
+	}()
+
+	f()
+}
+
+// leave record out of the task's later attempts.
+func skipRecord(task ITask, record BadRecord) {
+	switch task := task.(type) {
+	case *MapTask:
+		if !slices.Contains(task.SkipRecords, record.Index) {
+			task.SkipRecords = append(task.SkipRecords, record.Index)
+		}
+	case *ReduceTask:
+		if !slices.Contains(task.SkipKeys, record.Key) {
+			task.SkipKeys = append(task.SkipKeys, record.Key)
+		}
+	}
+}
+
+// the records later attempts of task leave out.
+func skippedRecords(task ITask) []BadRecord {
+	var records []BadRecord
+
+	switch task := task.(type) {
+	case *MapTask:
+		for _, index := range task.SkipRecords {
+			records = append(records, BadRecord{Index: index})
+		}
+	case *ReduceTask:
+		for _, key := range task.SkipKeys {
+			records = append(records, BadRecord{Key: key})
+		}
+	}
+
+	return records
+}
+
+// the records an attempt left out, as JSON lines.
+// the file is only created once there is one.
+type sideFile struct {
+	name    string
+	attempt int
+	file    *os.File
+	enc     KVEncoder
+	// the first error, reported by close. later writes are dropped.
+	err error
+}
+
+func (s *sideFile) write(kv *KeyValue) {
+	if s.err != nil {
+		return
+	}
+
+	if s.file == nil {
+		file, err := createTemp(s.name, s.attempt)
+		if err != nil {
+			s.err = fmt.Errorf("cannot create %v: %v", s.name, err)
+			return
+		}
+
+		s.file = file
+		s.enc = jsonCodec{}.NewEncoder(file)
+	}
+
+	if err := s.enc.Encode(kv); err != nil {
+		s.err = fmt.Errorf("cannot write %v: %v", s.name, err)
+	}
+}
+
+// close the file, if there is one, and add it to outputs. on error,
+// outputs are discarded along with the file.
+func (s *sideFile) close(outputs []OutputFile) ([]OutputFile, error) {
+	if s.err == nil && s.file != nil {
+		if err := s.enc.Close(); err != nil {
+			s.err = fmt.Errorf("cannot write %v: %v", s.name, err)
+		} else if err := closeTemp(s.file); err != nil {
+			s.err = fmt.Errorf("cannot write %v: %v", s.name, err)
+		} else {
+			outputs = append(outputs, OutputFile{TempName: s.file.Name(), FinalName: s.name})
+			s.file = nil
+		}
+	}
+
+	if s.err != nil {
+		discardOutputs(outputs)
+		s.discard()
+		return nil, s.err
+	}
+
+	return outputs, nil
+}
+
+// throw the file away, if there is one and it was not closed.
+func (s *sideFile) discard() {
+	if s.file != nil {
+		s.file.Close()
+		os.Remove(s.file.Name())
+		s.file = nil
+	}
+}
@@ -0,0 +1,84 @@
+package mr
+
+import (
+	"bufio"
+	"io"
+	"os"
+)
+
+// large input files are cut into splits of about the same size, each
+// read by a map task of its own. splits end on record boundaries, so
+// that no record is cut in two.
+
+// how many bytes of a file RecordBoundary implementations
+// read at once when looking for a boundary.
+const boundaryScanSize = 4 << 10
+
+// returns the offset of the first record that starts at or after
+// offset in a file of size bytes, or size if there is none.
+type RecordBoundary func(file io.ReaderAt, offset int64, size int64) (int64, error)
+
+// records are lines.
+func NewlineBoundary(file io.ReaderAt, offset int64, size int64) (int64, error) {
+	if offset <= 0 {
+		return 0, nil
+	}
+
+	// a line starts at offset if the line before ended right before it.
+	r := bufio.NewReaderSize(io.NewSectionReader(file, offset-1, size-offset+1), boundaryScanSize)
+	skipped, err := r.ReadSlice('\n')
+
+	for err == bufio.ErrBufferFull {
+		offset += int64(len(skipped))
+		skipped, err = r.ReadSlice('\n')
+	}
+
+	if err == io.EOF {
+		return size, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return offset + int64(len(skipped)) - 1, nil
+}
+
+type split struct {
+	offset int64
+	length int64
+}
+
+// cut a file into splits of about splitSize bytes. a file always has at
+// least one split, even if it is empty.
+func splitFile(filename string, splitSize int64, boundary RecordBoundary) ([]split, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	size := info.Size()
+	splits := []split{}
+
+	for offset := int64(0); offset < size || len(splits) == 0; {
+		end := size
+
+		if offset+splitSize < size {
+			end, err = boundary(file, offset+splitSize, size)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		splits = append(splits, split{offset: offset, length: end - offset})
+		offset = end
+	}
+
+	return splits, nil
+}
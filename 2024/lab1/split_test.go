@@ -0,0 +1,105 @@
+package mr
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var splitTestInputs = map[string]string{
+	"empty":               "",
+	"one newline":         "\n",
+	"lines":               "a\nbb\nccc\n\ndddd\n",
+	"no trailing newline": "a\nbb\nccc",
+	"no newline at all":   "abcdef",
+	"long line":           "a\n" + strings.Repeat("x", 3*boundaryScanSize+7) + "\nb\n",
+	"long last line":      "a\n" + strings.Repeat("x", 2*boundaryScanSize),
+	"line of scan size":   strings.Repeat("x", boundaryScanSize-1) + "\n" + strings.Repeat("y", boundaryScanSize) + "\n",
+}
+
+// the first offset at or after offset where a line starts, the slow way.
+func lineStart(data string, offset int64) int64 {
+	for i := max(offset, 0); i < int64(len(data)); i++ {
+		if i == 0 || data[i-1] == '\n' {
+			return i
+		}
+	}
+
+	return int64(len(data))
+}
+
+func TestNewlineBoundary(t *testing.T) {
+	for name, data := range splitTestInputs {
+		r := bytes.NewReader([]byte(data))
+		size := int64(len(data))
+
+		// every offset, including those right after a newline
+		// and those that are newlines themselves.
+		for offset := int64(0); offset <= size; offset++ {
+			got, err := NewlineBoundary(r, offset, size)
+			if err != nil {
+				t.Fatalf("%s: offset %d: %v", name, offset, err)
+			}
+
+			if want := lineStart(data, offset); got != want {
+				t.Fatalf("%s: boundary at or after %d is %d, want %d", name, offset, got, want)
+			}
+		}
+	}
+}
+
+func TestSplitFile(t *testing.T) {
+	dir := t.TempDir()
+
+	for name, data := range splitTestInputs {
+		filename := filepath.Join(dir, strings.ReplaceAll(name, " ", "-"))
+		if err := os.WriteFile(filename, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		size := int64(len(data))
+
+		for _, splitSize := range []int64{1, 2, 3, 100, boundaryScanSize, size, size + 1, 10 * size} {
+			if splitSize <= 0 {
+				continue
+			}
+
+			splits, err := splitFile(filename, splitSize, NewlineBoundary)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+
+			if len(splits) == 0 {
+				t.Fatalf("%s: no splits", name)
+			}
+
+			if splitSize >= size && len(splits) != 1 {
+				t.Fatalf("%s: %d splits of a file of %d bytes at split size %d, want 1", name, len(splits), size, splitSize)
+			}
+
+			// the splits cover the file in order, without gaps or
+			// overlaps, and every one but the last ends a line.
+			offset := int64(0)
+
+			for i, split := range splits {
+				if split.offset != offset {
+					t.Fatalf("%s: split %d of size %d starts at %d, want %d", name, i, splitSize, split.offset, offset)
+				}
+
+				offset += split.length
+
+				if i < len(splits)-1 {
+					if split.length <= 0 || data[offset-1] != '\n' {
+						t.Fatalf("%s: split %d of size %d ends at %d, inside a line", name, i, splitSize, offset)
+					}
+				}
+			}
+
+			if offset != size {
+				t.Fatalf("%s: splits of size %d end at %d, want %d", name, splitSize, offset, size)
+			}
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package mr
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// besides RPCs, the coordinator's HTTP server answers /status with a
+// page for humans, and /api/jobs, /api/tasks and /api/workers with the
+// same information as JSON for monitoring tools.
+
+type TaskState string
+
+const (
+	TaskIdle      TaskState = "idle"
+	TaskRunning   TaskState = "running"
+	TaskCompleted TaskState = "completed"
+	TaskSkipped   TaskState = "skipped"
+)
+
+type JobInfo struct {
+	Id     int
+	Stages []Stage
+	JobStatusReply
+}
+
+type TaskInfo struct {
+	Job   int
+	Stage string
+	Type  TaskType
+	Id    int
+	State TaskState
+	// workers running an attempt of the task right now.
+	Workers  []int
+	Attempts int
+	// failed attempts, and why the last of them failed.
+	Failures int
+	Error    string
+	// of the committed attempt, or of the oldest running one so far.
+	RuntimeSeconds float64
+	// files of the committed attempt.
+	Outputs []string
+}
+
+func (c *Coordinator) handleStatus() {
+	http.HandleFunc("/status", c.serveStatusPage)
+	http.HandleFunc("/api/jobs", func(w http.ResponseWriter, r *http.Request) {
+		jobs, _, _ := c.status(-1)
+		serveJSON(w, jobs)
+	})
+	http.HandleFunc("/api/tasks", func(w http.ResponseWriter, r *http.Request) {
+		jobId := -1
+
+		// ?job=N lists the tasks of one job only.
+		if value := r.URL.Query().Get("job"); value != "" {
+			var err error
+			if jobId, err = strconv.Atoi(value); err != nil {
+				http.Error(w, "bad job id", http.StatusBadRequest)
+				return
+			}
+		}
+
+		_, tasks, _ := c.status(jobId)
+		serveJSON(w, tasks)
+	})
+	http.HandleFunc("/api/workers", func(w http.ResponseWriter, r *http.Request) {
+		_, _, workers := c.status(-1)
+		serveJSON(w, workers)
+	})
+}
+
+func serveJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	if err := enc.Encode(v); err != nil {
+		log.Printf("cannot write status: %v", err)
+	}
+}
+
+// the jobs, the tasks of job jobId, or of all jobs if it is
+// negative, and the registered workers, sorted by id.
+func (c *Coordinator) status(jobId int) ([]JobInfo, []TaskInfo, []WorkerInfo) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	jobs := []JobInfo{}
+	tasks := []TaskInfo{}
+	workers := []WorkerInfo{}
+	now := time.Now()
+
+	for _, j := range c.jobs {
+		jobs = append(jobs, JobInfo{Id: j.id, Stages: j.spec.Stages, JobStatusReply: j.status()})
+
+		if jobId >= 0 && j.id != jobId {
+			continue
+		}
+
+		for _, task := range j.tasks {
+			tasks = append(tasks, j.taskInfo(task, now))
+		}
+	}
+
+	for _, worker := range c.workers {
+		workers = append(workers, *worker)
+	}
+
+	sort.Slice(workers, func(a, b int) bool {
+		return workers[a].Id < workers[b].Id
+	})
+
+	return jobs, tasks, workers
+}
+
+func (j *job) taskInfo(task ITask, now time.Time) TaskInfo {
+	info := TaskInfo{
+		Job:      j.id,
+		Stage:    task.GetStage(),
+		Type:     task.GetType(),
+		Id:       task.GetId(),
+		State:    TaskIdle,
+		Workers:  []int{},
+		Attempts: task.GetAttempt(),
+		Failures: task.GetFailures(),
+		Error:    task.GetError(),
+		Outputs:  []string{},
+	}
+
+	if task.IsSkipped() {
+		info.State = TaskSkipped
+		return info
+	}
+
+	if task.IsCompleted() {
+		info.State = TaskCompleted
+		info.RuntimeSeconds = task.GetRuntime().Seconds()
+
+		switch task := task.(type) {
+		case *MapTask:
+			if task.OutputFilename != "" {
+				info.Outputs = append(info.Outputs, task.OutputFilename)
+			}
+
+			for _, filename := range j.intermediates[task.Id] {
+				if filename != "" {
+					info.Outputs = append(info.Outputs, filename)
+				}
+			}
+		case *ReduceTask:
+			info.Outputs = append(info.Outputs, task.OutputFilename)
+		}
+
+		return info
+	}
+
+	for _, lease := range task.GetLeases() {
+		info.State = TaskRunning
+		info.Workers = append(info.Workers, lease.WorkerId)
+		info.RuntimeSeconds = max(info.RuntimeSeconds, now.Sub(lease.StartedAt).Seconds())
+	}
+
+	return info
+}
+
+var statusPage = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>MapReduce coordinator</title>
+<meta http-equiv="refresh" content="5">
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 2px 8px; text-align: left; }
+</style>
+</head>
+<body>
+<h1>Jobs</h1>
+<table>
+<tr><th>Job</th><th>State</th><th>Map tasks</th><th>Reduce tasks</th><th>Submitted</th><th>Finished</th><th>Counters</th><th>Errors</th></tr>
+{{range .Jobs}}<tr>
+<td>{{.Id}}</td>
+<td>{{.State}}</td>
+<td>{{.CompletedMapTasks}}/{{.MapTasks}}</td>
+<td>{{.CompletedReduceTasks}}/{{.ReduceTasks}}</td>
+<td>{{.SubmittedAt.Format "2006-01-02 15:04:05"}}</td>
+<td>{{if not .FinishedAt.IsZero}}{{.FinishedAt.Format "2006-01-02 15:04:05"}}{{end}}</td>
+<td>{{range $name, $value := .Counters}}{{$name}}: {{$value}}<br>{{end}}</td>
+<td>{{.Error}}{{range .Skipped}}skipped {{.}}<br>{{end}}</td>
+</tr>
+{{end}}</table>
+<h1>Workers</h1>
+<table>
+<tr><th>Worker</th><th>Last seen</th><th>Draining</th><th>Exited</th></tr>
+{{range .Workers}}<tr><td>{{.Id}}</td><td>{{.LastSeen.Format "15:04:05.000"}}</td><td>{{.Draining}}</td><td>{{.Exited}}</td></tr>
+{{end}}</table>
+<h1>Tasks</h1>
+<table>
+<tr><th>Job</th><th>Stage</th><th>Type</th><th>Task</th><th>State</th><th>Workers</th><th>Attempts</th><th>Failures</th><th>Runtime (s)</th><th>Output files</th></tr>
+{{range .Tasks}}<tr>
+<td>{{.Job}}</td>
+<td>{{.Stage}}</td>
+<td>{{.Type}}</td>
+<td>{{.Id}}</td>
+<td>{{.State}}</td>
+<td>{{range .Workers}}{{.}} {{end}}</td>
+<td>{{.Attempts}}</td>
+<td>{{.Failures}}{{if .Error}}: {{.Error}}{{end}}</td>
+<td>{{printf "%.2f" .RuntimeSeconds}}</td>
+<td>{{range .Outputs}}{{.}}<br>{{end}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+func (c *Coordinator) serveStatusPage(w http.ResponseWriter, r *http.Request) {
+	jobs, tasks, workers := c.status(-1)
+
+	data := struct {
+		Jobs    []JobInfo
+		Tasks   []TaskInfo
+		Workers []WorkerInfo
+	}{jobs, tasks, workers}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	if err := statusPage.Execute(w, data); err != nil {
+		log.Printf("cannot write status page: %v", err)
+	}
+}
@@ -1,17 +1,22 @@
 package mr
 
 import (
+	"context"
 	"encoding/gob"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"hash/fnv"
-	"io/ioutil"
+	"io"
 	"log"
 	"net/rpc"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"runtime/debug"
+	"slices"
 	"sort"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -29,6 +34,32 @@ func (a ByKey) Len() int           { return len(a) }
 func (a ByKey) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a ByKey) Less(i, j int) bool { return a[i].Key < a[j].Key }
 
+// the values of one key, read straight from the merged reduce input.
+type ValueIterator interface {
+	// returns false once the values of the key are exhausted.
+	Next() (string, bool)
+}
+
+// a reduce function that consumes the values of a key one at a time,
+// so that they never have to fit in memory together.
+type StreamingReduceFunc func(key string, values ValueIterator) string
+
+// lets slice-based reduce functions run on top of the value stream.
+// nil stays nil, so that a missing reduce function shows as such.
+func sliceReducer(reducef func(string, []string) string) StreamingReduceFunc {
+	if reducef == nil {
+		return nil
+	}
+
+	return func(key string, values ValueIterator) string {
+		all := []string{}
+		for value, ok := values.Next(); ok; value, ok = values.Next() {
+			all = append(all, value)
+		}
+		return reducef(key, all)
+	}
+}
+
 // use ihash(key) % NReduce to choose the reduce
 // task number for each KeyValue emitted by Map.
 func ihash(key string) int {
@@ -37,166 +68,884 @@ func ihash(key string) int {
 	return int(h.Sum32() & 0x7fffffff)
 }
 
-// main/mrworker.go calls this function.
-func Worker(mapf func(string, string) []KeyValue, reducef func(string, []string) string) {
+// calls that fail in transit are retried with exponential backoff,
+// for as long as the coordinator may take to restart.
+const (
+	MinBackoff   = 100 * time.Millisecond
+	MaxBackoff   = 2 * time.Second
+	RetryTimeout = 10 * time.Second
+)
+
+// the functions that run the tasks of a stage.
+type stageFuncs struct {
+	mapf     func(string, string) []KeyValue
+	reducef  StreamingReduceFunc
+	combinef func(string, []string) string
+}
+
+// state shared between the task loop and the heartbeat goroutine.
+type workerState struct {
+	mapf     func(string, string) []KeyValue
+	reducef  StreamingReduceFunc
+	combinef func(string, []string) string
+	// the functions of named pipeline stages.
+	stages            map[string]*stageFuncs
+	memoryBudget      int64
+	id                int
+	heartbeatInterval time.Duration
+	address           string
+	coordinator       *coordinatorClient
+	mutex             sync.Mutex
+	task              ITask
+	// cancels the attempt at task.
+	cancel context.CancelFunc
+	// closed when the worker shuts down.
+	stopped chan struct{}
+	metrics workerMetrics
+	// signals that drain the worker.
+	drainSignals []os.Signal
+}
+
+type WorkerOption func(*workerState)
+
+// run combinef over the output of every map task, one key at a time,
+// before it is written out. it must accept its own output as values,
+// so that reduce gives the same result whether or not it ran.
+// it applies to single-stage jobs; see WithStageCombiner.
+func WithCombiner(combinef func(string, []string) string) WorkerOption {
+	return func(w *workerState) {
+		w.combinef = combinef
+	}
+}
+
+// reduce with reducef, which iterates over the values of a key,
+// instead of the slice-based reduce function passed to Worker.
+// it applies to single-stage jobs; see WithStreamingStage.
+func WithStreamingReducer(reducef StreamingReduceFunc) WorkerOption {
+	return func(w *workerState) {
+		w.reducef = reducef
+	}
+}
+
+// run the tasks of the pipeline stage called name with mapf and
+// reducef. the functions passed to Worker run single-stage jobs.
+func WithStage(name string, mapf func(string, string) []KeyValue, reducef func(string, []string) string) WorkerOption {
+	return WithStreamingStage(name, mapf, sliceReducer(reducef))
+}
+
+// like WithStage, with a reduce function that iterates
+// over the values of a key.
+func WithStreamingStage(name string, mapf func(string, string) []KeyValue, reducef StreamingReduceFunc) WorkerOption {
+	return func(w *workerState) {
+		funcs := w.stage(name)
+		funcs.mapf, funcs.reducef = mapf, reducef
+	}
+}
+
+// like WithCombiner, for the map tasks of the pipeline stage called name.
+func WithStageCombiner(name string, combinef func(string, []string) string) WorkerOption {
+	return func(w *workerState) {
+		w.stage(name).combinef = combinef
+	}
+}
+
+// the functions of a stage, whichever option mentions it first.
+func (w *workerState) stage(name string) *stageFuncs {
+	if w.stages[name] == nil {
+		w.stages[name] = &stageFuncs{}
+	}
+
+	return w.stages[name]
+}
+
+// bound the KeyValue data a reduce task holds in memory while sorting
+// and merging its input, instead of DefaultMemoryBudget.
+func WithMemoryBudget(bytes int64) WorkerOption {
+	return func(w *workerState) {
+		w.memoryBudget = bytes
+	}
+}
+
+// dial unix:///path/to/socket or tcp://host:port
+// instead of the default UNIX socket.
+func WithCoordinatorAddress(address string) WorkerOption {
+	return func(w *workerState) {
+		w.address = address
+	}
+}
+
+// drain the worker on signals instead of SIGTERM: it finishes its
+// current task, then exits. with no signals, only the DrainWorker
+// RPC drains it.
+func WithDrainSignals(signals ...os.Signal) WorkerOption {
+	return func(w *workerState) {
+		w.drainSignals = signals
+	}
+}
+
+func (w *workerState) setTask(task ITask, cancel context.CancelFunc) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.task = task
+	w.cancel = cancel
+}
+
+// give up on the attempt at task, if we are still working on it.
+func (w *workerState) cancelTask(task ITask) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.task == task && w.cancel != nil {
+		log.Printf("worker %d cancelling %+v, another attempt won", w.id, task)
+		w.cancel()
+		w.cancel = nil
+	}
+}
+
+func (w *workerState) currentTask() ITask {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.task
+}
+
+// tell the coordinator that we are alive and still working on our
+// task, so that it keeps our lease.
+func (w *workerState) heartbeat() {
+	for {
+		select {
+		case <-w.stopped:
+			return
+		case <-time.After(w.heartbeatInterval):
+		}
+
+		task := w.currentTask()
+		ack, cancel := w.RpcHeartbeat(task)
+
+		if cancel {
+			w.cancelTask(task)
+		} else if !ack && task != nil {
+			log.Printf("worker %d lost the lease on %+v", w.id, task)
+		}
+	}
+}
+
+// ask the coordinator to drain us on the first drain signal.
+// a second one kills the worker as usual.
+func (w *workerState) drainOn(signals chan os.Signal) {
+	select {
+	case <-w.stopped:
+		return
+	case sig := <-signals:
+		signal.Reset(w.drainSignals...)
+		log.Printf("worker %d draining on %v", w.id, sig)
+		w.RpcDrainWorker()
+	}
+}
+
+// main/mrworker.go calls this function. reducef may be nil if
+// the worker only runs map-only or identity-reduce jobs.
+func Worker(mapf func(string, string) []KeyValue, reducef func(string, []string) string, opts ...WorkerOption) {
 	gob.Register(&MapTask{})
 	gob.Register(&ReduceTask{})
 	gob.Register(&IdleTask{})
+	gob.Register(&ExitTask{})
+
+	w := workerState{
+		mapf:         mapf,
+		reducef:      sliceReducer(reducef),
+		stages:       make(map[string]*stageFuncs),
+		memoryBudget: DefaultMemoryBudget,
+		address:      defaultCoordinatorAddress(),
+		stopped:      make(chan struct{}),
+		drainSignals: []os.Signal{syscall.SIGTERM},
+	}
+
+	for _, opt := range opts {
+		opt(&w)
+	}
+
+	network, address, err := parseAddress(w.address)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	w.coordinator = &coordinatorClient{network: network, address: address}
+	w.RpcRegisterWorker()
+	go w.heartbeat()
+	defer w.shutdown()
+
+	if len(w.drainSignals) > 0 {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, w.drainSignals...)
+		defer signal.Stop(signals)
+		go w.drainOn(signals)
+	}
 
 	for {
-		if task, err := RpcGetTask(); err == nil {
-			if task.Is(Map) {
-				if v, ok := task.(*MapTask); ok {
-					HandleMap(v, mapf)
-				}
+		if task, err := w.RpcGetTask(); err == nil {
+			if task.Is(Exit) {
+				// let the coordinator know that we heard.
+				w.RpcCompleteTask(task, nil, nil, nil)
+				return
 			}
 
-			if task.Is(Reduce) {
-				if v, ok := task.(*ReduceTask); ok {
-					HandleReduce(v, reducef)
-				}
+			if task.Is(Idle) {
+				// GetTask already waited for work, just ask again.
+				continue
 			}
 
-			if task.Is(Idle) {
-				time.Sleep(time.Second)
+			ctx, cancel := context.WithCancel(context.Background())
+			w.setTask(task, cancel)
+			takeCounters()
+
+			// files written by this attempt.
+			outputs, intermediateFilenames, err := w.runTask(ctx, task)
+
+			if err != nil {
+				log.Printf("worker %d failed %+v: %v", w.id, task, err)
+				discardOutputs(outputs)
+
+				if ctx.Err() == nil {
+					w.RpcFailTask(task, err)
+				}
+			} else if ctx.Err() == nil {
+				w.metrics.countTask(task, outputs)
+				w.RpcCompleteTask(task, outputs, intermediateFilenames, takeCounters())
+			} else {
+				// cancelled after the attempt was done with its files.
+				discardOutputs(outputs)
 			}
 
-			RpcCompleteTask(task)
+			w.setTask(nil, nil)
+			cancel()
 		} else {
-			break
+			log.Printf("worker %d stopping: %v", w.id, err)
+			return
 		}
 	}
 }
 
-func RpcGetTask() (ITask, error) {
-	args := GetTaskArgs{}
+// run a map or reduce task. a panic, in the task's map or reduce
+// function or elsewhere, fails the attempt rather than the worker.
+func (w *workerState) runTask(ctx context.Context, task ITask) (outputs []OutputFile, intermediateFilenames []string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if p, ok := r.(*recordPanic); ok {
+				log.Printf("worker %d recovered from a panic: %v\n%s", w.id, p.value, p.stack)
+				err = &badRecordError{record: p.record, err: fmt.Errorf("panic: %v", p.value)}
+				return
+			}
+
+			log.Printf("worker %d recovered from a panic: %v\n%s", w.id, r, debug.Stack())
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	switch task := task.(type) {
+	case *MapTask:
+		return w.HandleMap(ctx, task)
+	case *ReduceTask:
+		outputs, err = w.HandleReduce(ctx, task)
+		return outputs, nil, err
+	}
+
+	return nil, nil, nil
+}
+
+func (w *workerState) funcs(stage string) (*stageFuncs, error) {
+	if stage == "" {
+		return &stageFuncs{mapf: w.mapf, reducef: w.reducef, combinef: w.combinef}, nil
+	}
+
+	funcs, ok := w.stages[stage]
+	if !ok || funcs.mapf == nil {
+		return nil, fmt.Errorf("no functions for stage %q, see WithStage", stage)
+	}
+
+	return funcs, nil
+}
+
+func (w *workerState) shutdown() {
+	close(w.stopped)
+	w.coordinator.close()
+}
+
+func (w *workerState) RpcRegisterWorker() {
+	args := RegisterWorkerArgs{}
+	reply := RegisterWorkerReply{}
+
+	if !w.coordinator.call("Coordinator.RegisterWorker", &args, &reply) {
+		log.Fatal("cannot register with the coordinator")
+	}
+
+	w.id, w.heartbeatInterval = reply.WorkerId, reply.HeartbeatInterval
+}
+
+func (w *workerState) RpcDrainWorker() {
+	args := DrainWorkerArgs{WorkerId: w.id}
+	reply := DrainWorkerReply{}
+
+	if !w.coordinator.call("Coordinator.DrainWorker", &args, &reply) {
+		log.Printf("worker %d cannot drain, stopping anyway", w.id)
+		os.Exit(1)
+	}
+}
+
+// returns whether the lease on task was renewed, and whether
+// the attempt should be abandoned.
+func (w *workerState) RpcHeartbeat(task ITask) (bool, bool) {
+	args := HeartbeatArgs{WorkerId: w.id, Task: task, Metrics: w.metrics.snapshot()}
+	reply := HeartbeatReply{}
+
+	if !w.coordinator.call("Coordinator.Heartbeat", &args, &reply) {
+		return false, false
+	}
+
+	return reply.Ack, reply.Cancel
+}
+
+func (w *workerState) RpcGetTask() (ITask, error) {
+	args := GetTaskArgs{WorkerId: w.id}
 	reply := GetTaskReply{}
 
-	if !call("Coordinator.GetTask", &args, &reply) {
-		return reply.Task, errors.New("no more tasks")
+	if !w.coordinator.call("Coordinator.GetTask", &args, &reply) {
+		return reply.Task, errors.New("cannot get a task from the coordinator")
 	}
 
 	return reply.Task, nil
 }
 
-func RpcCompleteTask(task ITask) {
-	args := CompleteTaskArgs{Task: task}
+// returns true if the coordinator accepted this attempt.
+func (w *workerState) RpcCompleteTask(task ITask, outputs []OutputFile, intermediateFilenames []string, counters map[string]int64) bool {
+	args := CompleteTaskArgs{WorkerId: w.id, Task: task, Outputs: outputs, IntermediateFilenames: intermediateFilenames, Counters: counters}
 	reply := CompleteTaskReply{}
-	ok := call("Coordinator.CompleteTask", &args, &reply)
+	ok := w.coordinator.call("Coordinator.CompleteTask", &args, &reply)
 
 	if !ok {
 		fmt.Println("Something went wrong during CompleteTask")
 	}
+
+	return ok && reply.Ack
+}
+
+// tell the coordinator why we gave up on an attempt.
+func (w *workerState) RpcFailTask(task ITask, err error) {
+	args := FailTaskArgs{WorkerId: w.id, Task: task, Reason: err.Error()}
+	reply := FailTaskReply{}
+
+	var bad *badRecordError
+	if errors.As(err, &bad) {
+		args.BadRecord = &bad.record
+	}
+
+	if !w.coordinator.call("Coordinator.FailTask", &args, &reply) {
+		fmt.Println("Something went wrong during FailTask")
+	}
 }
 
-func HandleMap(task *MapTask, mapf func(string, string) []KeyValue) {
+// returns the intermediate files written by this attempt, and their
+// final names indexed by reduce partition. returns nothing if ctx
+// is cancelled, and an error if the input cannot be read.
+func (w *workerState) HandleMap(ctx context.Context, task *MapTask) ([]OutputFile, []string, error) {
 	file, err := os.Open(task.Filename)
 	if err != nil {
-		log.Fatalf("cannot open %v", task.Filename)
+		return nil, nil, fmt.Errorf("cannot open %v: %v", task.Filename, err)
 	}
-	content, err := ioutil.ReadAll(file)
+	defer file.Close()
+
+	var input io.Reader = file
+	if task.Length > 0 {
+		input = io.NewSectionReader(file, task.Offset, task.Length)
+	}
+
+	format, err := lookupInputFormat(task.InputFormat)
 	if err != nil {
-		log.Fatalf("cannot read %v", task.Filename)
+		return nil, nil, fmt.Errorf("cannot read %v: %v", task.Filename, err)
+	}
+
+	funcs, err := w.funcs(task.Stage)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if funcs.mapf == nil {
+		return nil, nil, errors.New("no map function")
+	}
+
+	side := &sideFile{name: skippedFilename(task.Job, task.Stage, Map, task.Id), attempt: task.Attempt}
+	defer side.discard()
+
+	var kva []KeyValue
+	index := 0
+	err = format.Read(task.Filename, task.Offset, input, func(key, value string) {
+		record := BadRecord{Index: index, Key: key}
+		index++
+
+		if slices.Contains(task.SkipRecords, record.Index) {
+			side.write(&KeyValue{Key: key, Value: value})
+			IncrCounter(SkippedMapRecords, 1)
+			return
+		}
+
+		guard(record, func() {
+			kva = append(kva, funcs.mapf(key, value)...)
+		})
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot read %v: %v", task.Filename, err)
+	}
+
+	if task.NReduce == 0 {
+		outputs, err := writeMapOutput(ctx, task, kva)
+		if outputs == nil || err != nil {
+			return nil, nil, err
+		}
+
+		outputs, err = side.close(outputs)
+		return outputs, nil, err
+	}
+
+	partitioner, err := makePartitioner(task.Partitioner)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot partition %v: %v", task.Filename, err)
 	}
-	file.Close()
-	kva := mapf(task.Filename, string(content))
 
 	kvaMap := make(map[int][]KeyValue)
+	var outputs []OutputFile
+	intermediateFilenames := make([]string, task.NReduce)
 
 	for _, kv := range kva {
-		reduceId := ihash(kv.Key) % task.NReduce
+		reduceId := partitioner.Partition(kv.Key, task.NReduce)
 		kvaMap[reduceId] = append(kvaMap[reduceId], kv)
 	}
 
 	for reduceId, kva := range kvaMap {
-		ofile, _ := os.OpenFile(fmt.Sprintf("mr-%d-%d", task.Id, reduceId), os.O_CREATE|os.O_WRONLY, 0644)
-		defer ofile.Close()
-		enc := json.NewEncoder(ofile)
+		if ctx.Err() != nil {
+			discardOutputs(outputs)
+			return nil, nil, nil
+		}
 
+		// before the file is created, so that a panicking
+		// combiner leaves nothing behind.
 		sort.Sort(ByKey(kva))
 
-		for _, kv := range kva {
-			err := enc.Encode(&kv)
+		if funcs.combinef != nil {
+			kva = combine(kva, funcs.combinef)
+		}
 
-			if err != nil {
-				panic(err)
+		oname := intermediateFilename(task.Job, task.Stage, task.Id, reduceId)
+		output, err := writeIntermediate(oname, task.Attempt, task.Codec, kva)
+		if err != nil {
+			discardOutputs(outputs)
+			return nil, nil, err
+		}
+
+		outputs = append(outputs, output)
+		intermediateFilenames[reduceId] = oname
+	}
+
+	outputs, err = side.close(outputs)
+	return outputs, intermediateFilenames, err
+}
+
+// write sorted kva to a private file of the attempt, to be
+// committed under oname.
+func writeIntermediate(oname string, attempt int, codec string, kva []KeyValue) (OutputFile, error) {
+	ofile, err := createTemp(oname, attempt)
+	if err != nil {
+		return OutputFile{}, fmt.Errorf("cannot create %v: %v", oname, err)
+	}
+
+	err = func() error {
+		enc, err := newKVEncoder(ofile, codec)
+		if err != nil {
+			return err
+		}
+
+		for _, kv := range kva {
+			if err := enc.Encode(&kv); err != nil {
+				return err
 			}
 		}
+
+		if err := enc.Close(); err != nil {
+			return err
+		}
+
+		return closeTemp(ofile)
+	}()
+
+	if err != nil {
+		ofile.Close()
+		os.Remove(ofile.Name())
+		return OutputFile{}, fmt.Errorf("cannot write %v: %v", oname, err)
 	}
+
+	return OutputFile{TempName: ofile.Name(), FinalName: oname}, nil
 }
 
-func HandleReduce(task *ReduceTask, reducef func(string, []string) string) {
-	wd, err := os.Getwd()
+// a map-only job has no reduce phase: its map tasks write their
+// output, unsorted, straight to the job's output files.
+func writeMapOutput(ctx context.Context, task *MapTask, kva []KeyValue) ([]OutputFile, error) {
+	if ctx.Err() != nil {
+		return nil, nil
+	}
 
+	oname := task.OutputFilename
+	ofile, err := createTemp(oname, task.Attempt)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("cannot create %v: %v", oname, err)
 	}
 
-	files, _ := filepath.Glob(fmt.Sprintf("%s/mr-[0-9]-%d", wd, task.GetId()))
-	var intermediate []KeyValue
+	err = func() error {
+		format, err := lookupOutputFormat(task.OutputFormat)
+		if err != nil {
+			return err
+		}
 
-	for _, filename := range files {
-		file, err := os.Open(filename)
+		enc, err := format.NewWriter(ofile)
 		if err != nil {
-			log.Fatalf("cannot open %v", filename)
+			return err
 		}
-		dec := json.NewDecoder(file)
-		for {
-			var kv KeyValue
-			if err := dec.Decode(&kv); err != nil {
-				break
+
+		for _, kv := range kva {
+			if err := enc.Encode(&kv); err != nil {
+				return err
 			}
-			intermediate = append(intermediate, kv)
 		}
+
+		if err := enc.Close(); err != nil {
+			return err
+		}
+
+		return closeTemp(ofile)
+	}()
+
+	if err != nil {
+		ofile.Close()
+		os.Remove(ofile.Name())
+		return nil, fmt.Errorf("cannot write %v: %v", oname, err)
+	}
+
+	return []OutputFile{{TempName: ofile.Name(), FinalName: oname}}, nil
+}
+
+// returns the output file written by this attempt, nothing if ctx is
+// cancelled, and an error if the input cannot be read or the output
+// cannot be written.
+func (w *workerState) HandleReduce(ctx context.Context, task *ReduceTask) ([]OutputFile, error) {
+	// input files are merged as they are, until one turns out not to
+	// be sorted. what was written until then is thrown away, and the
+	// task starts over with that file sorted first.
+	unsorted := make(map[string]bool)
+
+	for {
+		outputs, err := w.reduce(ctx, task, unsorted)
+
+		var unsortedErr *unsortedError
+		if !errors.As(err, &unsortedErr) || unsorted[unsortedErr.filename] {
+			return outputs, err
+		}
+
+		takeCounters()
+		unsorted[unsortedErr.filename] = true
+	}
+}
+
+func (w *workerState) reduce(ctx context.Context, task *ReduceTask, unsorted map[string]bool) ([]OutputFile, error) {
+	var spills []string
+	defer func() {
+		for _, spill := range spills {
+			os.Remove(spill)
+		}
+	}()
+
+	var reducef StreamingReduceFunc
+	if !task.Identity {
+		funcs, err := w.funcs(task.Stage)
+		if err != nil {
+			return nil, err
+		}
+
+		if funcs.reducef == nil {
+			return nil, errors.New("no reduce function")
+		}
+
+		reducef = funcs.reducef
 	}
 
-	sort.Sort(ByKey(intermediate))
+	format, err := lookupOutputFormat(task.OutputFormat)
+	if err != nil {
+		return nil, fmt.Errorf("cannot write %v: %v", task.OutputFilename, err)
+	}
+
+	input, err := openReduceInput(task.InputFilenames, unsorted, w.memoryBudget, &spills)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read input of reduce task %d: %w", task.Id, err)
+	}
+	defer input.Close()
 
-	oname := fmt.Sprintf("mr-out-%d", task.GetId())
-	ofile, _ := os.Create(oname)
+	oname := task.OutputFilename
+	ofile, err := createTemp(oname, task.Attempt)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create %v: %v", oname, err)
+	}
+
+	// unless the attempt gets as far as returning the file, it is thrown
+	// away, also when the reduce function panics.
+	finished := false
+	defer func() {
+		if !finished {
+			ofile.Close()
+			os.Remove(ofile.Name())
+		}
+	}()
+
+	enc, err := format.NewWriter(ofile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot write %v: %v", oname, err)
+	}
 
 	//
-	// call Reduce on each distinct key in intermediate[],
-	// and print the result to mr-out-0.
+	// call Reduce on each distinct key of the merged input,
+	// and write the result to the output file of the task.
 	//
+
+	side := &sideFile{name: skippedFilename(task.Job, task.Stage, Reduce, task.Id), attempt: task.Attempt}
+	defer side.discard()
+
+	kv, err := input.Next()
+	for err == nil {
+		if ctx.Err() != nil {
+			return nil, nil
+		}
+
+		// the input is already sorted, pass it through as is.
+		if task.Identity {
+			if err := enc.Encode(&kv); err != nil {
+				return nil, fmt.Errorf("cannot write %v: %v", oname, err)
+			}
+
+			kv, err = input.Next()
+			continue
+		}
+
+		values := &groupIterator{input: input, key: kv.Key, next: kv}
+
+		if slices.Contains(task.SkipKeys, kv.Key) {
+			for value, ok := values.Next(); ok; value, ok = values.Next() {
+				side.write(&KeyValue{Key: kv.Key, Value: value})
+			}
+
+			IncrCounter(SkippedReduceKeys, 1)
+			kv, err = values.next, values.err
+			continue
+		}
+
+		var output string
+		guard(BadRecord{Key: kv.Key}, func() {
+			output = reducef(kv.Key, values)
+		})
+
+		if err := enc.Encode(&KeyValue{Key: kv.Key, Value: output}); err != nil {
+			return nil, fmt.Errorf("cannot write %v: %v", oname, err)
+		}
+
+		// skip whatever reducef did not consume.
+		for {
+			if _, ok := values.Next(); !ok {
+				break
+			}
+		}
+		kv, err = values.next, values.err
+	}
+	if err != io.EOF {
+		return nil, fmt.Errorf("cannot read input of reduce task %d: %w", task.Id, err)
+	}
+
+	if err := enc.Close(); err != nil {
+		return nil, fmt.Errorf("cannot write %v: %v", oname, err)
+	}
+
+	if err := closeTemp(ofile); err != nil {
+		return nil, fmt.Errorf("cannot write %v: %v", oname, err)
+	}
+
+	outputs, err := side.close([]OutputFile{{TempName: ofile.Name(), FinalName: oname}})
+	if err != nil {
+		return nil, err
+	}
+
+	finished = true
+
+	return outputs, nil
+}
+
+// iterates over the values of one key of a sorted stream. it reads one
+// KeyValue ahead, which is where the next key starts.
+type groupIterator struct {
+	input kvStream
+	key   string
+	next  KeyValue
+	err   error
+}
+
+func (g *groupIterator) Next() (string, bool) {
+	if g.err != nil || g.next.Key != g.key {
+		return "", false
+	}
+
+	value := g.next.Value
+	g.next, g.err = g.input.Next()
+
+	return value, true
+}
+
+// collapse every run of equal keys in sorted kva into one KeyValue.
+func combine(kva []KeyValue, combinef func(string, []string) string) []KeyValue {
+	var combined []KeyValue
+
 	i := 0
-	for i < len(intermediate) {
+	for i < len(kva) {
 		j := i + 1
-		for j < len(intermediate) && intermediate[j].Key == intermediate[i].Key {
+		for j < len(kva) && kva[j].Key == kva[i].Key {
 			j++
 		}
 		values := []string{}
 		for k := i; k < j; k++ {
-			values = append(values, intermediate[k].Value)
+			values = append(values, kva[k].Value)
 		}
-		output := reducef(intermediate[i].Key, values)
-
-		// this is the correct format for each line of Reduce output.
-		fmt.Fprintf(ofile, "%v %v\n", intermediate[i].Key, output)
+		combined = append(combined, KeyValue{Key: kva[i].Key, Value: combinef(kva[i].Key, values)})
 
 		i = j
 	}
 
-	ofile.Close()
+	IncrCounter(CombineInputRecords, int64(len(kva)))
+	IncrCounter(CombineOutputRecords, int64(len(combined)))
 
+	return combined
 }
 
-// send an RPC request to the coordinator, wait for the response.
-// usually returns true.
-// returns false if something goes wrong.
-func call(rpcname string, args interface{}, reply interface{}) bool {
-	// c, err := rpc.DialHTTP("tcp", "127.0.0.1"+":1234")
-	sockname := coordinatorSock()
-	c, err := rpc.DialHTTP("unix", sockname)
-	if err != nil {
-		log.Fatal("dialing:", err)
+// workers never write under a final name. every attempt writes to a
+// private file in the same directory, which the coordinator renames
+// once it accepts the attempt.
+func createTemp(finalName string, attempt int) (*os.File, error) {
+	pattern := fmt.Sprintf("mr-tmp-%s-%d-*", strings.TrimPrefix(finalName, "mr-"), attempt)
+	return os.CreateTemp(".", pattern)
+}
+
+// the data must be on disk before the coordinator makes it visible.
+// the file is closed either way.
+func closeTemp(file *os.File) error {
+	err := file.Sync()
+
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// a connection to the coordinator, shared by the task loop and the
+// heartbeat goroutine. it is redialed whenever a call fails in transit.
+type coordinatorClient struct {
+	network string
+	address string
+	mutex   sync.Mutex
+	client  *rpc.Client
+}
+
+func (cc *coordinatorClient) connect() (*rpc.Client, error) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	if cc.client == nil {
+		client, err := rpc.DialHTTP(cc.network, cc.address)
+		if err != nil {
+			return nil, err
+		}
+
+		cc.client = client
 	}
-	defer c.Close()
 
-	err = c.Call(rpcname, args, reply)
-	if err == nil {
-		return true
+	return cc.client, nil
+}
+
+func (cc *coordinatorClient) disconnect(client *rpc.Client) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	if cc.client == client {
+		cc.client.Close()
+		cc.client = nil
 	}
+}
 
-	return false
+func (cc *coordinatorClient) close() {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	if cc.client != nil {
+		cc.client.Close()
+		cc.client = nil
+	}
+}
+
+// send an RPC request to the coordinator, wait for the response.
+// usually returns true.
+// returns false if the coordinator returned an error, or could not
+// be reached for RetryTimeout.
+func (cc *coordinatorClient) call(rpcname string, args interface{}, reply interface{}) bool {
+	return cc.invoke(rpcname, args, reply) == nil
+}
+
+// like call, but returns the error.
+func (cc *coordinatorClient) invoke(rpcname string, args interface{}, reply interface{}) error {
+	return cc.send(rpcname, args, reply, true)
+}
+
+// like invoke, for requests that must not reach the coordinator twice.
+// it retries only while the coordinator cannot be dialed, and gives up
+// once a request may have been sent.
+func (cc *coordinatorClient) invokeOnce(rpcname string, args interface{}, reply interface{}) error {
+	return cc.send(rpcname, args, reply, false)
+}
+
+func (cc *coordinatorClient) send(rpcname string, args interface{}, reply interface{}, resend bool) error {
+	deadline := time.Now().Add(RetryTimeout)
+	backoff := MinBackoff
+
+	for {
+		client, err := cc.connect()
+
+		if err == nil {
+			err = client.Call(rpcname, args, reply)
+
+			if err == nil {
+				return nil
+			}
+
+			// the coordinator got the request and refused it,
+			// trying again will not change its mind.
+			if _, ok := err.(rpc.ServerError); ok {
+				return err
+			}
+
+			cc.disconnect(client)
+
+			if !resend {
+				return err
+			}
+		}
+
+		if time.Now().Add(backoff).After(deadline) {
+			log.Printf("giving up on %v: %v", rpcname, err)
+			return err
+		}
+
+		time.Sleep(backoff)
+		backoff = min(2*backoff, MaxBackoff)
+	}
 }
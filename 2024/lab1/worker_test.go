@@ -0,0 +1,235 @@
+package mr
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func testWorker() *workerState {
+	return &workerState{
+		mapf: func(filename string, contents string) []KeyValue {
+			var kva []KeyValue
+			for _, word := range strings.Fields(contents) {
+				kva = append(kva, KeyValue{Key: word, Value: "1"})
+			}
+			return kva
+		},
+		reducef:      sliceReducer(func(key string, values []string) string { return "x" }),
+		stages:       make(map[string]*stageFuncs),
+		memoryBudget: DefaultMemoryBudget,
+	}
+}
+
+func checkNoTempFiles(t *testing.T) {
+	if temps, _ := filepath.Glob("mr-tmp-*"); len(temps) > 0 {
+		t.Fatalf("attempt left %v behind", temps)
+	}
+}
+
+// errors that would fail every attempt of a task fail the attempt,
+// rather than the worker, and leave no files behind.
+func TestTaskErrors(t *testing.T) {
+	chdirTemp(t)
+
+	if err := os.WriteFile("input", []byte("a b c a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := testWorker()
+	ctx := context.Background()
+
+	mapTasks := map[string]*MapTask{
+		"unknown codec":         {Filename: "input", NReduce: 2, Codec: "nope"},
+		"unknown partitioner":   {Filename: "input", NReduce: 2, Partitioner: PartitionerConfig{Name: "nope"}},
+		"unknown output format": {Filename: "input", OutputFilename: "mr-out-0", OutputFormat: "nope"},
+		"no functions for":      {Task: Task{Stage: "nope"}, Filename: "input", NReduce: 2},
+	}
+
+	for want, task := range mapTasks {
+		outputs, _, err := w.HandleMap(ctx, task)
+
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("map task got error %v, want %q", err, want)
+		}
+
+		if outputs != nil {
+			t.Fatalf("failed map task returned %v", outputs)
+		}
+
+		checkNoTempFiles(t)
+	}
+
+	reduceTasks := map[string]*ReduceTask{
+		"unknown output format": {OutputFilename: "mr-out-0", OutputFormat: "nope"},
+		"no functions for":      {Task: Task{Stage: "nope"}, OutputFilename: "mr-out-0"},
+	}
+
+	for want, task := range reduceTasks {
+		outputs, err := w.HandleReduce(ctx, task)
+
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("reduce task got error %v, want %q", err, want)
+		}
+
+		if outputs != nil {
+			t.Fatalf("failed reduce task returned %v", outputs)
+		}
+
+		checkNoTempFiles(t)
+	}
+}
+
+// a worker without a map or reduce function fails its tasks for that
+// reason, rather than blaming a record.
+func TestMissingFunctions(t *testing.T) {
+	chdirTemp(t)
+
+	if err := os.WriteFile("input", []byte("a b c a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	writeKVs(t, "mr-0-0-0", DefaultCodec, []KeyValue{{Key: "a", Value: "1"}})
+
+	w := testWorker()
+	w.mapf, w.reducef = nil, sliceReducer(nil)
+	ctx := context.Background()
+
+	_, _, err := w.HandleMap(ctx, &MapTask{Filename: "input", NReduce: 1})
+	if err == nil || err.Error() != "no map function" {
+		t.Fatalf("map task got error %v, want no map function", err)
+	}
+
+	_, err = w.HandleReduce(ctx, &ReduceTask{InputFilenames: []string{"mr-0-0-0"}, OutputFilename: "mr-out-0"})
+	if err == nil || err.Error() != "no reduce function" {
+		t.Fatalf("reduce task got error %v, want no reduce function", err)
+	}
+
+	checkNoTempFiles(t)
+
+	// an identity reduce needs none.
+	outputs, err := w.HandleReduce(ctx, &ReduceTask{Identity: true, InputFilenames: []string{"mr-0-0-0"}, OutputFilename: "mr-out-0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	discardOutputs(outputs)
+}
+
+func TestNewJobChecksNames(t *testing.T) {
+	specs := map[string]JobSpec{
+		"unknown codec":       {Stages: []Stage{{NReduce: 1}}, Codec: "nope"},
+		"unknown partitioner": {Stages: []Stage{{NReduce: 1}}, Partitioner: PartitionerConfig{Name: "nope"}},
+	}
+
+	for want, spec := range specs {
+		if _, err := newJob(1, spec, nil); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("newJob got error %v, want %q", err, want)
+		}
+	}
+}
+
+// a reduce task whose input is not sorted starts over, and neither
+// its output nor its counters show the first try.
+func TestReduceUnsortedInput(t *testing.T) {
+	chdirTemp(t)
+
+	writeKVs(t, "sorted", DefaultCodec, []KeyValue{{Key: "a", Value: "1"}, {Key: "c", Value: "1"}})
+	writeKVs(t, "unsorted", DefaultCodec, []KeyValue{{Key: "b", Value: "1"}, {Key: "a", Value: "1"}, {Key: "b", Value: "1"}})
+
+	w := testWorker()
+	w.reducef = func(key string, values ValueIterator) string {
+		IncrCounter("keys", 1)
+		n := 0
+		for _, ok := values.Next(); ok; _, ok = values.Next() {
+			n++
+		}
+		return strconv.Itoa(n)
+	}
+
+	takeCounters()
+	task := &ReduceTask{InputFilenames: []string{"sorted", "unsorted"}, OutputFilename: "mr-out-0"}
+
+	outputs, err := w.HandleReduce(context.Background(), task)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(outputs[0].TempName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	discardOutputs(outputs)
+
+	if want := "a 2\nb 2\nc 1\n"; string(data) != want {
+		t.Fatalf("output %q, want %q", data, want)
+	}
+
+	if keys := takeCounters()["keys"]; keys != 3 {
+		t.Fatalf("keys counter is %d, want 3", keys)
+	}
+
+	checkNoTempFiles(t)
+}
+
+// a map function that panics fails the attempt on its record, and an
+// attempt that skips the record writes it to the side file instead.
+func TestBadRecordSkipping(t *testing.T) {
+	chdirTemp(t)
+
+	if err := os.WriteFile("input", []byte("a\nbad\nc\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := testWorker()
+	w.mapf = func(key string, value string) []KeyValue {
+		if value == "bad" {
+			panic("bad record")
+		}
+		return []KeyValue{{Key: value, Value: "1"}}
+	}
+
+	ctx := context.Background()
+	task := &MapTask{Filename: "input", NReduce: 1, InputFormat: "lines"}
+
+	_, _, err := w.runTask(ctx, task)
+
+	var bad *badRecordError
+	if !errors.As(err, &bad) || bad.record != (BadRecord{Index: 1, Key: "2"}) {
+		t.Fatalf("got error %v, want one on record 1 at offset 2", err)
+	}
+
+	checkNoTempFiles(t)
+
+	takeCounters()
+	task.SkipRecords = []int{1}
+
+	outputs, _, err := w.runTask(ctx, task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer discardOutputs(outputs)
+
+	if n := takeCounters()[SkippedMapRecords]; n != 1 {
+		t.Fatalf("%d skipped records counted, want 1", n)
+	}
+
+	skipped := skippedFilename(0, "", Map, 0)
+
+	for _, output := range outputs {
+		if output.FinalName != skipped {
+			continue
+		}
+
+		if got := readKVs(t, output.TempName); len(got) != 1 || got[0] != (KeyValue{Key: "2", Value: "bad"}) {
+			t.Fatalf("side file holds %v, want the bad record", got)
+		}
+
+		return
+	}
+
+	t.Fatalf("no side file among %v", outputs)
+}